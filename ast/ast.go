@@ -1,19 +1,25 @@
 package ast
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"regexp"
 	"strconv"
 	"strings"
 
+	"github.com/zkry/go-sed/posix"
 	"github.com/zkry/go-sed/token"
 )
 
 type Program struct {
 	Statements []statement
-	Labels     map[string]int
+	Labels     map[string]int // The statement each label is followed by.
 	Tokens     []token.Token
+	rangeCt    int            // The number of range addresses in the program.
+	zeroRanges []int          // The indexes of the 0,/re/ ranges, which are active from the start.
+	spans      []span         // Where each statement is in the script.
+	labelPos   map[string]int // Where each label is in the script.
+	comments   []comment      // The comments of the script, in order.
 }
 
 type addresser interface {
@@ -34,96 +40,100 @@ func (s *aStmt) Run(r *runtime) {
 	r.appendSpace += s.AppendLine + "\n"
 }
 
+// bStmt branches to the statement Target, which is the one following
+// Label, or the end of the script if there is no label.
 type bStmt struct {
 	addresser
-	BranchIdent string
+	Label  string
+	Target int
 }
 
 func (s *bStmt) Run(r *runtime) {
-	r.directives.jumpTo = s.BranchIdent
+	r.jump(s.Target)
 }
 
 type cStmt struct {
 	addresser
 	ChangeLine string
-	prevResult bool
 }
 
 func (s *cStmt) Run(r *runtime) {
-	// TODO: To be implemented
-	switch s.addresser.(type) {
-	case *rangeAddress:
-		match := s.Address(r)
-		if !match {
-			if s.prevResult {
-				// output the ChangeLine
-				r.directives.deleteCmd = true
-				r.output += s.ChangeLine + "\n"
-			}
-			s.prevResult = false
-			return
-		}
-		r.directives.deleteCmd = true
-		s.prevResult = true
-	default:
-		match := s.Address(r)
-		if !match {
-			return
-		}
-		r.directives.deleteCmd = true
-		r.output += s.ChangeLine + "\n"
+	r.directives.deleteCmd = true
+	// With a range, the text is only output once the range has ended.
+	if a, ok := s.addresser.(ranger); ok && r.ranges[a.rangeIndex()].active {
+		return
 	}
+	r.write(s.ChangeLine + "\n")
 }
 
 // SFlags represents the various options that can be passed to the s command.
 // The zero value means the flag is not set.
 type sFlags struct {
-	NFlag int    // N - Make the substitution only for the Nth occurence of regexp
+	NFlag int    // N - Make the substitution only for the Nth occurence of regexp, or from it on with g
 	GFlag bool   // g - Make the substitution for all non-overlapping matches
 	PFlag bool   // p - Write the pattern space to stdout
+	IFlag bool   // I - Match the regexp regardless of case
+	MFlag bool   // M - Make ^ and $ match around embedded newlines
+	EFlag bool   // e - Execute the pattern space as a command and replace it with the output
+	PExec bool   // Whether p came before e, printing the pattern space before it is executed
 	WFile string // w file  - append pattern space to file if a replacement made.
 }
 
 type sStmt struct {
 	addresser
 	FindAddr    string
+	Regexp      posix.Matcher // Nil if the last regexp used should be reused.
 	ReplaceAddr string
+	Replacement replacement
 	Flags       sFlags
 }
 
 func (s *sStmt) Run(r *runtime) {
-	var rgxp *regexp.Regexp
-	var err error
+	rgxp := r.useRegexp(s.Regexp)
+	if rgxp == nil {
+		return
+	}
+	matches, err := posix.FindAllStringSubmatchIndex(rgxp, r.patternSpace, -1)
+	if err != nil {
+		r.searchFailed(err)
+		return
+	}
+	// Replace only the nth occurence, the first by default, or with g
+	// every occurence from the nth on.
+	n := 1
+	if s.Flags.NFlag != 0 {
+		n = s.Flags.NFlag
+	}
+	if len(matches) < n {
+		return
+	}
 	if s.Flags.GFlag {
-		// Replace for all occurences.
-		rgxp, err = regexp.Compile(s.FindAddr)
-		if err != nil {
-			return
-		}
-		r.subMade = true
-		r.patternSpace = rgxp.ReplaceAllString(r.patternSpace, s.ReplaceAddr)
+		matches = matches[n-1:]
 	} else {
-		matchIdx := 0
-		if s.Flags.NFlag != 0 {
-			// Replace for nth occurence.
-			matchIdx = s.Flags.NFlag - 1
-		}
+		matches = matches[n-1 : n]
+	}
 
-		// } else {
-		// Replace for first occurence.
-		rgxp, err = regexp.Compile(s.FindAddr)
-		if err != nil {
-			return
-		}
-		loc := rgxp.FindAllStringIndex(r.patternSpace, -1)
-		if loc == nil {
-			return
-		}
-		r.subMade = true
-		r.patternSpace = r.patternSpace[0:loc[matchIdx][0]] + rgxp.ReplaceAllString(r.patternSpace[loc[matchIdx][0]:loc[matchIdx][1]], s.ReplaceAddr) + r.patternSpace[loc[matchIdx][1]:len(r.patternSpace)]
+	var buff bytes.Buffer
+	last := 0
+	for _, m := range matches {
+		buff.WriteString(r.patternSpace[last:m[0]])
+		s.Replacement.expand(&buff, r.patternSpace, m)
+		last = m[1]
 	}
-	if s.Flags.PFlag {
-		r.output += r.patternSpace + "\n"
+	buff.WriteString(r.patternSpace[last:])
+	r.subMade = true
+	r.patternSpace = buff.String()
+	if s.Flags.PFlag && s.Flags.PExec {
+		r.writeLine(r.patternSpace)
+	}
+	if s.Flags.EFlag {
+		r.execPatternSpace()
+	}
+	if s.Flags.PFlag && !s.Flags.PExec {
+		r.writeLine(r.patternSpace)
+	}
+	if s.Flags.WFile != "" {
+		r.writeFile(s.Flags.WFile, r.patternSpace)
 	}
 }
 
@@ -135,6 +145,9 @@ func (s *dStmt) Run(r *runtime) {
 	r.directives.deleteCmd = true
 }
 
+// d2Stmt deletes the first line of the pattern space and restarts the
+// script with what is left, without reading input or printing. With only
+// one line in the pattern space, it is the same as d.
 type d2Stmt struct {
 	addresser
 }
@@ -143,18 +156,43 @@ func (s *d2Stmt) Run(r *runtime) {
 	idx := strings.IndexRune(r.patternSpace, '\n')
 	if idx == -1 {
 		r.directives.deleteCmd = true
+		return
 	}
 	r.patternSpace = r.patternSpace[idx+1:]
 	r.directives.restartScript = true
 }
 
+// eStmt runs Command and writes out its output. Without a command, the
+// pattern space is run and replaced by the output instead.
 type eStmt struct {
 	addresser
 	Command string
 }
 
 func (s *eStmt) Run(r *runtime) {
-	// TODO: To be implemented
+	if s.Command == "" {
+		r.execPatternSpace()
+		return
+	}
+	if out, ok := r.shell(s.Command); ok {
+		r.write(out)
+	}
+}
+
+// fStmt prints the name of the input.
+type fStmt struct {
+	addresser
+}
+
+func (s *fStmt) Run(r *runtime) {
+	name := r.input.name
+	if name == "" {
+		name = r.options.InputName
+	}
+	if name == "" {
+		name = "-"
+	}
+	r.write(name + "\n")
 }
 
 type gStmt struct {
@@ -195,14 +233,68 @@ type iStmt struct {
 }
 
 func (s *iStmt) Run(r *runtime) {
-	r.output += s.InsertLine + "\n"
+	r.write(s.InsertLine + "\n")
 }
 
+// lStmt prints the pattern space unambiguously, as done by listLine.
 type lStmt struct {
 	addresser
+	Width int // The width to wrap at, or -1 to use the runtime's.
 }
 
 func (s *lStmt) Run(r *runtime) {
+	width := s.Width
+	if width < 0 {
+		width = r.options.LineLength
+	}
+	r.write(listLine(r.patternSpace, width))
+}
+
+// listLine returns s as written by the l command. Tabs, newlines and the
+// other C escapes are written as such, backslashes are doubled and any
+// other byte that is not printable ASCII is written as a 3 digit octal
+// escape. The end of s is marked by a $. Lines longer than width are
+// wrapped with a trailing \, without breaking up an escape. A width of 0
+// never wraps.
+func listLine(s string, width int) string {
+	var b strings.Builder
+	col := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		var esc string
+		switch c {
+		case '\\':
+			esc = `\\`
+		case '\a':
+			esc = `\a`
+		case '\b':
+			esc = `\b`
+		case '\f':
+			esc = `\f`
+		case '\n':
+			esc = `\n`
+		case '\r':
+			esc = `\r`
+		case '\t':
+			esc = `\t`
+		case '\v':
+			esc = `\v`
+		default:
+			if c < ' ' || c > '~' {
+				esc = fmt.Sprintf("\\%03o", c)
+			} else {
+				esc = string(c)
+			}
+		}
+		if width > 0 && col+len(esc) > width-1 {
+			b.WriteString("\\\n")
+			col = 0
+		}
+		b.WriteString(esc)
+		col += len(esc)
+	}
+	b.WriteString("$\n")
+	return b.String()
 }
 
 type nStmt struct {
@@ -210,23 +302,34 @@ type nStmt struct {
 }
 
 func (s *nStmt) Run(r *runtime) {
-	r.directives.nextCmd = true
+	if r.input.isLast() {
+		r.directives.quitCmd = true
+		return
+	}
+	if r.options.AutoPrint {
+		r.writeLine(r.patternSpace)
+	}
+	r.patternSpace, _ = r.readLine()
 }
 
+// n2Stmt appends the next line of input to the pattern space. If there is
+// none, sed quits, printing the pattern space as GNU sed does unless the
+// run is POSIXLY_CORRECT.
 type n2Stmt struct {
 	addresser
 }
 
 func (s *n2Stmt) Run(r *runtime) {
-	r.lineNo++
-	if r.lineNo >= len(r.lines) {
-		r.directives.quitNoPattern = true
+	if r.input.isLast() {
+		if r.options.Posix {
+			r.directives.quitNoPattern = true
+		} else {
+			r.directives.quitCmd = true
+		}
 		return
 	}
-	r.patternSpace += "\n" + r.lines[r.lineNo]
-	fmt.Println("  Current pattern space:")
-	fmt.Println(r.patternSpace)
-	fmt.Println("  ======================")
+	line, _ := r.readLine()
+	r.patternSpace += "\n" + line
 }
 
 type pStmt struct {
@@ -234,37 +337,53 @@ type pStmt struct {
 }
 
 func (s *pStmt) Run(r *runtime) {
-	r.output += r.patternSpace + "\n"
+	r.writeLine(r.patternSpace)
 }
 
+// p2Stmt prints the pattern space up to and including the first newline.
 type p2Stmt struct {
 	addresser
 }
 
 func (s *p2Stmt) Run(r *runtime) {
-	fmt.Println("Running P2 statement")
 	idx := strings.IndexRune(r.patternSpace, '\n')
 	if idx == -1 {
-		r.output += r.patternSpace
+		r.writeLine(r.patternSpace)
 		return
 	}
-	r.output += r.patternSpace[:idx]
+	r.write(r.patternSpace[:idx+1])
 }
 
+// qStmt quits once the pattern space and any appended text is printed,
+// exiting with Code.
 type qStmt struct {
 	addresser
+	Code int
 }
 
 func (s *qStmt) Run(r *runtime) {
+	r.result.ExitCode = s.Code
 	r.directives.quitCmd = true
 }
 
+// q2Stmt quits at once without printing, exiting with Code.
+type q2Stmt struct {
+	addresser
+	Code int
+}
+
+func (s *q2Stmt) Run(r *runtime) {
+	r.result.ExitCode = s.Code
+	r.directives.quitSilent = true
+}
+
 type rStmt struct {
 	addresser
 	FileName string
 }
 
 func (s *rStmt) Run(r *runtime) {
+	r.appendSpace += r.files.readAll(s.FileName)
 }
 
 type r2Stmt struct {
@@ -273,37 +392,58 @@ type r2Stmt struct {
 }
 
 func (s *r2Stmt) Run(r *runtime) {
-	// To be implemented
+	if line, ok := r.files.readLine(s.FileName); ok {
+		r.appendSpace += line + "\n"
+	}
 }
 
+// tStmt branches like bStmt if a substitution was made since the last
+// input line was read or the last t branched.
 type tStmt struct {
 	addresser
-	BranchIdent string
+	Label  string
+	Target int
 }
 
 func (s *tStmt) Run(r *runtime) {
 	if r.subMade {
 		r.subMade = false
-		r.directives.jumpTo = s.BranchIdent
+		r.jump(s.Target)
 	}
 }
 
+// t2Stmt branches like bStmt if no substitution was made since the last
+// input line was read or the last t or T branched.
 type t2Stmt struct {
 	addresser
-	FileName string
+	Label  string
+	Target int
 }
 
 func (s *t2Stmt) Run(r *runtime) {
-	// To be implemented
+	if !r.subMade {
+		r.jump(s.Target)
+		return
+	}
+	r.subMade = false
 }
 
+// vStmt does nothing, the version it requires having been checked when
+// the program was compiled.
+type vStmt struct {
+	addresser
+	Version string
+}
+
+func (s *vStmt) Run(r *runtime) {}
+
 type wStmt struct {
 	addresser
 	FileName string
 }
 
 func (s *wStmt) Run(r *runtime) {
-	// To be implemented
+	r.writeFile(s.FileName, r.patternSpace)
 }
 
 type w2Stmt struct {
@@ -312,7 +452,11 @@ type w2Stmt struct {
 }
 
 func (s *w2Stmt) Run(r *runtime) {
-	// To be implemented
+	line := r.patternSpace
+	if idx := strings.IndexRune(line, '\n'); idx != -1 {
+		line = line[:idx]
+	}
+	r.writeFile(s.FileName, line)
 }
 
 type xStmt struct {
@@ -325,6 +469,8 @@ func (s *xStmt) Run(r *runtime) {
 
 type yStmt struct {
 	addresser
+	Find    string // The characters to replace, as written.
+	Replace string // The characters replacing them, as written.
 	charMap map[rune]rune
 }
 
@@ -341,17 +487,11 @@ func (s *yStmt) Run(r *runtime) {
 }
 
 func newYStmt(find, replace string, addr addresser) (*yStmt, error) {
-	fRunes := []rune{}
-	rRunes := []rune{}
-	for _, r := range find {
-		fRunes = append(fRunes, r)
-	}
-	for _, r := range replace {
-		rRunes = append(rRunes, r)
-	}
+	fRunes := yRunes(find)
+	rRunes := yRunes(replace)
 
 	if len(fRunes) != len(rRunes) {
-		return nil, errors.New("transform strings are not the same length")
+		return nil, errors.New("strings for `y' command are different lengths")
 	}
 
 	cm := make(map[rune]rune)
@@ -359,7 +499,44 @@ func newYStmt(find, replace string, addr addresser) (*yStmt, error) {
 		cm[fRunes[i]] = rRunes[i]
 	}
 
-	return &yStmt{charMap: cm}, nil
+	return &yStmt{addresser: addr, Find: find, Replace: replace, charMap: cm}, nil
+}
+
+// yRunes returns the characters of an operand of the y command. In it \n
+// stands for a newline, along with \t, \r, \f, \v and \a, and a backslash
+// followed by any other character for that character, so \\ stands for a
+// backslash.
+func yRunes(s string) []rune {
+	rs := []rune{}
+	escaped := false
+	for _, r := range s {
+		if !escaped && r == '\\' {
+			escaped = true
+			continue
+		}
+		if escaped {
+			switch r {
+			case 'n':
+				r = '\n'
+			case 't':
+				r = '\t'
+			case 'r':
+				r = '\r'
+			case 'f':
+				r = '\f'
+			case 'v':
+				r = '\v'
+			case 'a':
+				r = '\a'
+			}
+			escaped = false
+		}
+		rs = append(rs, r)
+	}
+	if escaped {
+		rs = append(rs, '\\')
+	}
+	return rs
 }
 
 type zStmt struct {
@@ -367,7 +544,7 @@ type zStmt struct {
 }
 
 func (s *zStmt) Run(r *runtime) {
-	// To be implemented
+	r.patternSpace = ""
 }
 
 type equStmt struct {
@@ -375,25 +552,35 @@ type equStmt struct {
 }
 
 func (s *equStmt) Run(r *runtime) {
-	r.output += strconv.Itoa(r.lineNo+1) + "\n"
+	r.write(strconv.Itoa(r.lineNo) + "\n")
 }
 
+// blockStmt starts a block, whose statements follow it in the program up
+// to End. If the address does not match, execution continues at End.
 type blockStmt struct {
-	Code *Program
 	addresser
+	End    int
+	endPos int // Where the closing } is in the script.
 }
 
-func (s *blockStmt) Run(r *runtime) {
-	fmt.Println("↓ Running BlockStmt")
-	r.directives.runBlock = s.Code
-}
+func (s *blockStmt) Run(r *runtime) {}
 
 type regexpAddr struct {
-	Regexp *regexp.Regexp
+	Regexp  posix.Matcher // Nil if the last regexp used should be reused.
+	Pattern string        // The regexp as written, without its delimiters.
+	Flags   posix.Flags
 }
 
 func (a *regexpAddr) Address(r *runtime) bool {
-	return len(a.Regexp.FindIndex([]byte(r.patternSpace))) > 0
+	re := r.useRegexp(a.Regexp)
+	if re == nil {
+		return false
+	}
+	ok, err := posix.MatchString(re, r.patternSpace)
+	if err != nil {
+		r.searchFailed(err)
+	}
+	return ok
 }
 
 type lineNoAddr struct {
@@ -401,7 +588,7 @@ type lineNoAddr struct {
 }
 
 func (a *lineNoAddr) Address(r *runtime) bool {
-	if r.lineNo+1 == a.LineNo {
+	if r.lineNo == a.LineNo {
 		return true
 	}
 	return false
@@ -410,7 +597,7 @@ func (a *lineNoAddr) Address(r *runtime) bool {
 type eofAddr struct{}
 
 func (a *eofAddr) Address(r *runtime) bool {
-	return r.lineNo == len(r.lines)-1
+	return r.input.isLast()
 }
 
 type notAddr struct {
@@ -418,27 +605,160 @@ type notAddr struct {
 }
 
 func (a *notAddr) Address(r *runtime) bool {
-	return !a.Address(r)
+	return !a.Addr.Address(r)
+}
+
+// stepAddr matches every Step-th line starting with line First, the GNU
+// first~step address. A Step of 0 matches line First alone.
+type stepAddr struct {
+	First int
+	Step  int
+}
+
+func (a *stepAddr) Address(r *runtime) bool {
+	if a.Step <= 0 {
+		return r.lineNo == a.First
+	}
+	return r.lineNo >= a.First && (r.lineNo-a.First)%a.Step == 0
 }
 
+// ranger is implemented by the addresses matching a range of lines. The
+// state of a range is kept in the runtime under its index so that the
+// program itself is never modified by a run.
+type ranger interface {
+	addresser
+	rangeIndex() int
+}
+
+// rangeAddress matches every line from one matching Addr1 up to and
+// including the next line matching Addr2. As in POSIX, Addr2 is not
+// checked against the line opening the range, and a range whose end is
+// never found runs to the end of the input. If Addr2 is a line number no
+// greater than the opening line, the range is that line alone.
 type rangeAddress struct {
 	Addr1 addresser
 	Addr2 addresser
-	on    bool
+	index int
 }
 
 func (a *rangeAddress) Address(r *runtime) bool {
-	if a.on {
+	st := &r.ranges[a.index]
+	end, isLineNo := a.Addr2.(*lineNoAddr)
+	if !st.active {
+		if !startRange(r, st, a.Addr1) {
+			return false
+		}
+		st.active = !isLineNo || end.LineNo > r.lineNo
+		return true
+	}
+	if !isLineNo {
 		if a.Addr2.Address(r) {
-			a.on = false
+			st.active = false
 		}
 		return true
 	}
-	if a.Addr1.Address(r) {
-		a.on = true
+	switch {
+	case r.lineNo > end.LineNo:
+		// The last line was read by n or N without the range being
+		// checked. Like GNU sed, the range ends without this line, which
+		// only matches if it matches Addr1.
+		st.active = false
+		return a.Addr1.Address(r)
+	case r.lineNo == end.LineNo:
+		st.active = false
+	}
+	return true
+}
+
+func (a *rangeAddress) rangeIndex() int { return a.index }
+
+// startRange reports whether the range with the state st, which is not
+// active, starts on the current line. As in GNU sed, a range starting at a
+// line number also starts on a later line if n or N read over that line,
+// but it only ever starts once.
+func startRange(r *runtime, st *rangeState, addr1 addresser) bool {
+	a, ok := addr1.(*lineNoAddr)
+	if !ok {
+		return addr1.Address(r)
+	}
+	if st.started || r.lineNo < a.LineNo {
+		return false
+	}
+	st.started = true
+	return true
+}
+
+// zeroRangeAddress is the GNU 0,/re/ address, a range that is active from
+// the start of the run so that Addr2 can end it on the first line.
+type zeroRangeAddress struct {
+	Addr2 addresser
+	index int
+}
+
+func (a *zeroRangeAddress) Address(r *runtime) bool {
+	st := &r.ranges[a.index]
+	if !st.active {
+		return false
+	}
+	if a.Addr2.Address(r) {
+		st.active = false
+	}
+	return true
+}
+
+func (a *zeroRangeAddress) rangeIndex() int { return a.index }
+
+// relRangeAddress is the GNU addr1,+N address, matching a line matching
+// Addr1 and the N lines following it.
+type relRangeAddress struct {
+	Addr1 addresser
+	N     int
+	index int
+}
+
+func (a *relRangeAddress) Address(r *runtime) bool {
+	return lineRange(r, a.index, a.Addr1, a.N)
+}
+
+func (a *relRangeAddress) rangeIndex() int { return a.index }
+
+// multRangeAddress is the GNU addr1,~N address, matching from a line
+// matching Addr1 up to the next line whose number is a multiple of N. As
+// in GNU sed, a range starting on a multiple runs to the one after it.
+type multRangeAddress struct {
+	Addr1 addresser
+	N     int
+	index int
+}
+
+func (a *multRangeAddress) Address(r *runtime) bool {
+	n := 0
+	if a.N > 0 {
+		n = a.N - r.lineNo%a.N
+	}
+	return lineRange(r, a.index, a.Addr1, n)
+}
+
+func (a *multRangeAddress) rangeIndex() int { return a.index }
+
+// lineRange matches a line matching addr1 and the n lines following it,
+// using the range state under index. n is only used when the range
+// starts.
+func lineRange(r *runtime, index int, addr1 addresser, n int) bool {
+	st := &r.ranges[index]
+	if st.active {
+		if r.lineNo >= st.end {
+			st.active = false
+		}
 		return true
 	}
-	return false
+	if !startRange(r, st, addr1) {
+		return false
+	}
+	if n > 0 {
+		st.active, st.end = true, r.lineNo+n
+	}
+	return true
 }
 
 type blankAddress struct{}
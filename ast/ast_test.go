@@ -1 +1,480 @@
 package ast
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zkry/go-sed/lexer"
+	"github.com/zkry/go-sed/posix"
+)
+
+// runProgram parses and runs program over input, failing the test if the
+// program does not parse.
+func runProgram(t *testing.T, program, input string, opt RuntimeOptions) string {
+	t.Helper()
+	p := New(lexer.New(program), posix.BRE)
+	prg := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("Program %s encountered errors %v", program, p.Errors())
+	}
+	return prg.Run(input, opt)
+}
+
+func TestBlock(t *testing.T) {
+	tests := []struct {
+		program string
+		output  string
+	}{
+		{program: `2!d`, output: "2"},
+		{program: `2,3!d`, output: "2\n3"},
+		{program: `/[24]/!s/$/x/`, output: "1x\n2\n3x\n4"},
+		{program: `2{p;p}`, output: "1\n2\n2\n2\n3\n4"},
+		{program: `2!{s/^/>/}`, output: ">1\n2\n>3\n>4"},
+		{program: `1,3{/2/!{s/$/!/}}`, output: "1!\n2\n3!\n4"},
+		{program: `2{d};s/$/./`, output: "1.\n3.\n4."},
+		{program: `2{n;s/$/+/}`, output: "1\n2\n3+\n4"},
+		{program: `3{q};s/$/-/`, output: "1-\n2-\n3"},
+		{program: `/2/{:loop;s/^.\{1,3\}$/&_/;t loop}`, output: "1\n2___\n3\n4"},
+		{program: `2{3{p}}`, output: "1\n2\n3\n4"},
+		{program: `{{{s/1/one/}}}`, output: "one\n2\n3\n4"},
+		{program: `$!{h;d};x;G`, output: "3\n4"},
+		{program: `2{x;p;x}`, output: "1\n\n2\n3\n4"},
+		{program: "1{b end\n};s/$/?/;:end", output: "1\n2?\n3?\n4?"},
+		{program: "1b in\n2{:in\ns/$/!/\n}", output: "1!\n2!\n3\n4"},
+		{program: `2b;s/$/./`, output: "1.\n2\n3.\n4."},
+		{program: `s/[13]/&&/;t;s/$/./`, output: "11\n2.\n33\n4."},
+		{program: `/2/{s/2/x/;b};s/$/./`, output: "1.\nx\n3.\n4."},
+	}
+
+	for i, tt := range tests {
+		out := runProgram(t, tt.program, "1\n2\n3\n4", RuntimeOptions{AutoPrint: true})
+		if out != tt.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n Expected: %q\n Got: %q\n", i, tt.program, tt.output, out)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		program    string
+		input      string
+		lineLength int
+		output     string
+	}{
+		{program: `l`, input: "a\tb\\c\x01\x7f é", output: "a\\tb\\\\c\\001\\177 \\303\\251$\n"},
+		{program: `N;l`, input: "a\nb", output: "a\\nb$\n"},
+		{program: `l`, input: "xxxxxxxxxx", lineLength: 5, output: "xxxx\\\nxxxx\\\nxx$\n"},
+		{program: `l 10`, input: "xxxxxxxx\t\t\t", lineLength: 5, output: "xxxxxxxx\\\n\\t\\t\\t$\n"},
+		{program: `l 0`, input: "xxxxxxxxxx", lineLength: 5, output: "xxxxxxxxxx$\n"},
+		{program: `l 1`, input: "xx", output: "\\\nx\\\nx$\n"},
+		{program: `l;l 2`, input: "xx", lineLength: 0, output: "xx$\nx\\\nx$\n"},
+	}
+
+	for i, tt := range tests {
+		out := runProgram(t, tt.program, tt.input, RuntimeOptions{LineLength: tt.lineLength})
+		if out+"\n" != tt.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n Expected: %q\n Got: %q\n", i, tt.program, tt.output, out+"\n")
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		program string
+		output  string
+	}{
+		{program: "s/1/X/;T;s/$/!/", output: "X!\n2\n3"},
+		{program: "s/1/X/;Tend;s/$/!/;:end", output: "X!\n2\n3"},
+		{program: "s/[12]/X/;s/3/Y/;T;s/$/!/", output: "X!\nX!\nY!"},
+		{program: "2z", output: "1\n\n3"},
+		{program: "2y/123/abc/", output: "1\nb\n3"},
+		{program: "2,3y/123/abc/", output: "1\nb\nc"},
+		{program: "2!y/123/abc/", output: "a\n2\nc"},
+		{program: "/3/y/3/x/", output: "1\n2\nx"},
+		{program: "F", output: "-\n1\n-\n2\n-\n3"},
+		{program: "2Q", output: "1"},
+		{program: "2q", output: "1\n2"},
+		{program: "2a\\\nx\n2Q", output: "1"},
+		{program: "2a\\\nx\n2q", output: "1\n2\nx"},
+		{program: "$!d;=", output: "3\n3"},
+		{program: "v;v 4.2", output: "1\n2\n3"},
+		{program: "s/.*/echo hi/;e", output: "hi\nhi\nhi"},
+		{program: "1e echo cmd", output: "cmd\n1\n2\n3"},
+	}
+
+	for i, tt := range tests {
+		out := runProgram(t, tt.program, "1\n2\n3", RuntimeOptions{AutoPrint: true, AllowExec: true})
+		if out != tt.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n Expected: %q\n Got: %q\n", i, tt.program, tt.output, out)
+		}
+	}
+}
+
+// TestMultiline checks N, P and D against the output of GNU sed, with and
+// without POSIXLY_CORRECT set.
+func TestMultiline(t *testing.T) {
+	tests := []struct {
+		program string
+		posix   bool
+		output  string
+	}{
+		{program: "$!N;P;D", output: "1\n2\n3\n4\n5"},
+		{program: "$!N;P;D", posix: true, output: "1\n2\n3\n4\n5"},
+		{program: "N;P;D", output: "1\n2\n3\n4\n5"},
+		{program: "N;P;D", posix: true, output: "1\n2\n3\n4"},
+		{program: "N;N;s/\\n/+/g", output: "1+2+3\n4\n5"},
+		{program: "N;N;s/\\n/+/g", posix: true, output: "1+2+3"},
+		{program: "3a\\\nx\nN", output: "1\n2\nx\n3\n4\n5"},
+		{program: "3a\\\nx\nN", posix: true, output: "1\n2\nx\n3\n4"},
+		{program: "N;a\\\nx\nP;D", output: "1\nx\n2\nx\n3\nx\n4\n5\nx"},
+		{program: "N;a\\\nx\nP;D", posix: true, output: "1\nx\n2\nx\n3\nx\n4\nx"},
+		{program: "$!N;s/\\n/ /;P;D", output: "1 2\n3 4\n5"},
+		{program: "1!G;h;$!d", output: "5\n4\n3\n2\n1"},
+		{program: "N;l;D", output: "1\\n2$\n2\\n3$\n3\\n4$\n4\\n5$\n5"},
+	}
+
+	for i, tt := range tests {
+		out := runProgram(t, tt.program, "1\n2\n3\n4\n5", RuntimeOptions{AutoPrint: true, Posix: tt.posix})
+		if out != tt.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n Expected: %q\n Got: %q\n", i, tt.program, tt.output, out)
+		}
+	}
+}
+
+// TestStepper checks the output and the pattern and hold space left by
+// each cycle.
+func TestStepper(t *testing.T) {
+	p := New(lexer.New("x;2q"), posix.BRE)
+	prg := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("Program encountered errors %v", p.Errors())
+	}
+
+	cycles := []struct {
+		output, pattern, hold string
+	}{
+		{output: "\n", pattern: "", hold: "1"},
+		{output: "1\n", pattern: "1", hold: "2"},
+	}
+	s := prg.NewStepper(strings.NewReader("1\n2\n3\n"), RuntimeOptions{AutoPrint: true})
+	for i, c := range cycles {
+		var out bytes.Buffer
+		if !s.Step(&out) {
+			t.Fatalf("Cycle %d: expected the cycle to run", i)
+		}
+		if out.String() != c.output || s.PatternSpace() != c.pattern || s.HoldSpace() != c.hold {
+			t.Errorf("Cycle %d: expected output %q, pattern %q and hold %q, got %q, %q and %q",
+				i, c.output, c.pattern, c.hold, out.String(), s.PatternSpace(), s.HoldSpace())
+		}
+		if s.LineNo() != i+1 {
+			t.Errorf("Cycle %d: expected line %d, got %d", i, i+1, s.LineNo())
+		}
+	}
+	if s.Step(ioutil.Discard) {
+		t.Errorf("Expected no cycle to run after q")
+	}
+	if res := s.Close(); !res.Quit || res.LinesRead != 2 {
+		t.Errorf("Unexpected result %+v", res)
+	}
+}
+
+// recordTracer writes each event of a run to w, where the output of the
+// run also goes.
+type recordTracer struct {
+	w *bytes.Buffer
+}
+
+func (t recordTracer) StartCycle(lineNo int, pattern, hold string) {
+	fmt.Fprintf(t.w, "start %d %q %q\n", lineNo, pattern, hold)
+}
+
+func (t recordTracer) Address(stmt StmtInfo, matched bool) {
+	fmt.Fprintf(t.w, "address %d %s %v\n", stmt.Index, stmt.Text, matched)
+}
+
+func (t recordTracer) Exec(stmt StmtInfo, pattern, hold string) {
+	fmt.Fprintf(t.w, "exec %d %q %q\n", stmt.Index, pattern, hold)
+}
+
+func (t recordTracer) Branch(stmt StmtInfo, target int) {
+	fmt.Fprintf(t.w, "branch %d %d\n", stmt.Index, target)
+}
+
+func (t recordTracer) EndCycle(pattern, hold string) {
+	fmt.Fprintf(t.w, "end %q %q\n", pattern, hold)
+}
+
+// TestTracer checks the events of a traced run, and that the output comes
+// between them in the order it is written.
+func TestTracer(t *testing.T) {
+	program := "2!{p;h};/2/bx;G;:x"
+	p := New(lexer.New(program), posix.BRE)
+	prg := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("Program encountered errors %v", p.Errors())
+	}
+
+	var out bytes.Buffer
+	opt := RuntimeOptions{AutoPrint: true, Tracer: recordTracer{&out}}
+	prg.Exec(context.Background(), strings.NewReader("1\n2\n"), &out, opt)
+	expected := `start 1 "1" ""
+address 0 2! { true
+exec 0 "1" ""
+address 1 p true
+1
+exec 1 "1" ""
+address 2 h true
+exec 2 "1" "1"
+address 3 /2/ b x false
+address 4 G true
+exec 4 "1\n1" "1"
+end "1\n1" "1"
+1
+1
+start 2 "2" "1"
+address 0 2! { false
+address 3 /2/ b x true
+exec 3 "2" "1"
+branch 3 5
+end "2" "1"
+2
+`
+	if out.String() != expected {
+		t.Errorf("Expected trace:\n%s\nGot:\n%s", expected, out.String())
+	}
+
+	infos := prg.StmtInfos()
+	if infos[1].Depth != 1 || program[infos[1].Start:infos[1].End] != "p" {
+		t.Errorf("Unexpected statement %+v", infos[1])
+	}
+}
+
+func TestExecFlag(t *testing.T) {
+	tests := []struct {
+		program   string
+		allowExec bool
+		output    string
+	}{
+		{program: `s/.*/echo hi/e`, allowExec: true, output: "hi"},
+		{program: `s/.*/echo hi/e`, allowExec: false, output: "echo hi"},
+		{program: `s/.*/echo hi/pe`, allowExec: true, output: "echo hi\nhi"},
+		{program: `s/.*/echo hi/ep`, allowExec: true, output: "hi\nhi"},
+	}
+
+	for i, tt := range tests {
+		out := runProgram(t, tt.program, "x", RuntimeOptions{AutoPrint: true, AllowExec: tt.allowExec})
+		if out != tt.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n Expected: %q\n Got: %q\n", i, tt.program, tt.output, out)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	snippet := filepath.Join(dir, "snippet.txt")
+	if err := ioutil.WriteFile(snippet, []byte("s1\ns2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.txt")
+
+	tests := []struct {
+		program string
+		input   string
+		output  string
+	}{
+		{
+			program: "/b/r " + snippet,
+			input:   "a\nb\nc",
+			output:  "a\nb\ns1\ns2\nc",
+		},
+		{
+			program: "r " + snippet + "\ni\\\nbefore",
+			input:   "a",
+			output:  "before\na\ns1\ns2",
+		},
+		{
+			program: "r " + missing,
+			input:   "a\nb",
+			output:  "a\nb",
+		},
+		{
+			program: "R " + snippet,
+			input:   "a\nb\nc",
+			output:  "a\ns1\nb\ns2\nc",
+		},
+		{
+			program: "R " + snippet + "\nR " + snippet,
+			input:   "a\nb",
+			output:  "a\ns1\ns2\nb",
+		},
+		{
+			program: "R " + missing,
+			input:   "a\nb",
+			output:  "a\nb",
+		},
+		{
+			program: "N;R " + snippet,
+			input:   "a\nb\nc\nd",
+			output:  "a\nb\ns1\nc\nd\ns2",
+		},
+	}
+
+	opt := RuntimeOptions{AutoPrint: true}
+	for i, tt := range tests {
+		out := runProgram(t, tt.program, tt.input, opt)
+		if out != tt.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n Expected:\n-----\n%s\n-----\n Got:\n-----\n%s\n-----\n", i, tt.program, tt.output, out)
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out.txt")
+	unused := filepath.Join(dir, "unused.txt")
+
+	tests := []struct {
+		program    string
+		input      string
+		appendFile bool
+		output     string
+		file       string
+		fileData   string
+	}{
+		{
+			program:  "/b/w " + out,
+			input:    "a\nb\nc\nb",
+			output:   "a\nb\nc\nb",
+			file:     out,
+			fileData: "b\nb\n",
+		},
+		{
+			program:  "N;W " + out,
+			input:    "a\nb\nc\nd",
+			output:   "a\nb\nc\nd",
+			file:     out,
+			fileData: "a\nc\n",
+		},
+		{
+			program:  "s/a/A/w " + out + "\n/c/w " + out,
+			input:    "a\nb\nc",
+			output:   "A\nb\nc",
+			file:     out,
+			fileData: "A\nc\n",
+		},
+		{
+			program:  "1{\nw " + out + "\n}",
+			input:    "a\nb",
+			output:   "a\nb",
+			file:     out,
+			fileData: "a\n",
+		},
+		{
+			program:  "/x/w " + unused,
+			input:    "a\nb",
+			output:   "a\nb",
+			file:     unused,
+			fileData: "",
+		},
+		{
+			program:    "w " + out,
+			input:      "c",
+			appendFile: true,
+			output:     "c",
+			file:       out,
+			fileData:   "a\nc\n",
+		},
+		{
+			program: "w /dev/stdout",
+			input:   "a\nb",
+			output:  "a\na\nb\nb",
+		},
+	}
+
+	for i, tt := range tests {
+		if tt.file != "" {
+			if err := ioutil.WriteFile(tt.file, []byte("a\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		opt := RuntimeOptions{AutoPrint: true, AppendFile: tt.appendFile}
+		got := runProgram(t, tt.program, tt.input, opt)
+		if got != tt.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n Expected:\n-----\n%s\n-----\n Got:\n-----\n%s\n-----\n", i, tt.program, tt.output, got)
+		}
+		if tt.file == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Errorf("Program [%d] %s: could not read %s: %v", i, tt.program, tt.file, err)
+			continue
+		}
+		if string(data) != tt.fileData {
+			t.Errorf("Program [%d] %s wrote incorrect file data.\n Expected: %q\n Got: %q\n", i, tt.program, tt.fileData, string(data))
+		}
+	}
+}
+
+func TestReplacement(t *testing.T) {
+	tests := []struct {
+		program string
+		input   string
+		output  string
+	}{
+		{program: `s/b/[&]/`, input: "abc", output: "a[b]c"},
+		{program: `s/b/[\&]/`, input: "abc", output: "a[&]c"},
+		{program: `s&b&\&&`, input: "abc", output: "a&c"},
+		{program: `s/\(a\)\(b\)/\2\1/`, input: "abc", output: "bac"},
+		{program: `s/b/\0\0/`, input: "abc", output: "abbc"},
+		{program: `s/b/\n/`, input: "abc", output: "a\nc"},
+		{program: "s/b/1\\\n2/", input: "abc", output: "a1\n2c"},
+		{program: `s/b/\\/`, input: "abc", output: `a\c`},
+		{program: `s/b/$1$/`, input: "abc", output: "a$1$c"},
+		{program: `s/b/\//`, input: "abc", output: "a/c"},
+		{program: `s/\(a\)\|b/[\1]/g`, input: "ab", output: "[a][]"},
+		{program: `s/x*/-/g`, input: "abc", output: "-a-b-c-"},
+		{program: `s/./(&)/2`, input: "abc", output: "a(b)c"},
+		{program: `s/b*/x/2`, input: "abc", output: "axc"},
+		{program: `s/\(.\)\1/<\1>/g`, input: "aabccd", output: "<a>b<c>d"},
+		{program: `s/\(.\)\(.*\)/\u\1\L\2/`, input: "hELLO", output: "Hello"},
+		{program: `s/.*/\U&/`, input: "abc", output: "ABC"},
+		{program: `s/b/\U&x\Ey/`, input: "abc", output: "aBXyc"},
+		{program: `s/\w\+/\L\u&/g`, input: "ONE tWO", output: "One Two"},
+		{program: `s/\w\+/\l&/`, input: "ONE", output: "oNE"},
+		{program: `s/\(x*\)\(b\)/\u\1\2/`, input: "abc", output: "aBc"},
+		{program: `s/.*/\u\L&/`, input: "hELLO wOrld", output: "hello world"},
+		{program: `s/.*/\l\U&/`, input: "hello", output: "HELLO"},
+		{program: `s/.*/\u\E&/`, input: "hello", output: "hello"},
+		{program: `s/é/\U&/`, input: "café", output: "cafÉ"},
+		{program: `s/a/b/3g`, input: "aaaaa", output: "aabbb"},
+		{program: `s/a/b/11`, input: "aaaaaaaaaaaa", output: "aaaaaaaaaaba"},
+		{program: `s/AB/x/Ig`, input: "ab Ab aB", output: "x x x"},
+		{program: `s/-/\n/g;s/^b/>/MIg`, input: "a-B-b", output: "a\n>\n>"},
+		{program: `s/-/\n/;s/a.*$/x/M`, input: "ab-a", output: "x\na"},
+	}
+
+	opt := RuntimeOptions{AutoPrint: true}
+	for i, tt := range tests {
+		out := runProgram(t, tt.program, tt.input, opt)
+		if out != tt.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n Expected: %q\n Got: %q\n", i, tt.program, tt.output, out)
+		}
+	}
+}
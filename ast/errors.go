@@ -0,0 +1,133 @@
+package ast
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zkry/go-sed/token"
+)
+
+// ErrorCode identifies the kind of a CompileError.
+type ErrorCode string
+
+const (
+	ErrUnexpectedToken  ErrorCode = "unexpected-token"
+	ErrUnknownCommand   ErrorCode = "unknown-command"
+	ErrExpectedToken    ErrorCode = "expected-token"
+	ErrInvalidLabel     ErrorCode = "invalid-label"
+	ErrInvalidFlag      ErrorCode = "invalid-flag"
+	ErrInvalidRegexp    ErrorCode = "invalid-regexp"
+	ErrInvalidReference ErrorCode = "invalid-reference"
+	ErrLengthMismatch   ErrorCode = "length-mismatch"
+)
+
+// CompileError describes a problem found in a script while compiling it.
+// Line and Column are 1-based, with the column counted in characters.
+// Start and End are the byte offsets in the script of the text the error
+// refers to.
+type CompileError struct {
+	File       string // The name of the script, if known.
+	Line       int
+	Column     int
+	Start, End int
+	Code       ErrorCode
+	Msg        string
+	Text       string // The line of the script the error occurred on.
+}
+
+func (e *CompileError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// Render returns the error followed by the line of the script it occurred
+// on, with the offending text marked by carets underneath.
+func (e *CompileError) Render() string {
+	var buff bytes.Buffer
+	buff.WriteString(e.Error() + "\n")
+	buff.WriteString("\t" + e.Text + "\n")
+	buff.WriteRune('\t')
+	col, off := 1, 0
+	for _, r := range e.Text {
+		if col >= e.Column {
+			break
+		}
+		if r == '\t' {
+			buff.WriteRune('\t')
+		} else {
+			buff.WriteRune(' ')
+		}
+		col++
+		off += utf8.RuneLen(r)
+	}
+	marked := e.Text[off:]
+	if n := e.End - e.Start; n < len(marked) {
+		marked = marked[:n]
+	}
+	width := utf8.RuneCountInString(marked)
+	if width < 1 {
+		width = 1
+	}
+	buff.WriteString(strings.Repeat("^", width) + "\n")
+	return buff.String()
+}
+
+// ErrorList is the list of errors found while compiling a script.
+type ErrorList []*CompileError
+
+func (e ErrorList) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// newCompileError returns an error pointing at tok in the program src.
+// The offsets of tok count characters, which are converted to bytes.
+func newCompileError(src string, tok token.Token, code ErrorCode, msg string) *CompileError {
+	runes := []rune(src)
+	start, end := clamp(tok.Start, len(runes)), clamp(tok.End, len(runes))
+	// Tokens include the blanks skipped before them.
+	for start < end && (runes[start] == ' ' || runes[start] == '\t') {
+		start++
+	}
+
+	lineStart := 0
+	line := 1
+	for i := 0; i < start; i++ {
+		if runes[i] == '\n' {
+			lineStart = i + 1
+			line++
+		}
+	}
+	lineEnd := lineStart
+	for lineEnd < len(runes) && runes[lineEnd] != '\n' {
+		lineEnd++
+	}
+
+	byteStart := len(string(runes[:start]))
+	return &CompileError{
+		Line:   line,
+		Column: start - lineStart + 1,
+		Start:  byteStart,
+		End:    byteStart + len(string(runes[start:end])),
+		Code:   code,
+		Msg:    msg,
+		Text:   string(runes[lineStart:lineEnd]),
+	}
+}
+
+func clamp(i, max int) int {
+	if i < 0 {
+		return 0
+	}
+	if i > max {
+		return max
+	}
+	return i
+}
@@ -0,0 +1,177 @@
+package ast
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// fileManager keeps track of the files used by a single run of a program.
+// Files read by the R command stay open between cycles so that each call
+// continues where the last one left off. Files written to are opened once
+// at the start of the run and shared by every command writing to them.
+type fileManager struct {
+	readers map[string]*fileReader
+	writers map[string]*fileWriter
+	err     error // The first error encountered writing to a file.
+}
+
+type fileReader struct {
+	f   *os.File
+	r   *bufio.Reader
+	eof bool
+}
+
+type fileWriter struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+// Special file names that refer to the standard streams instead of files.
+const (
+	stdoutFile = "/dev/stdout"
+	stderrFile = "/dev/stderr"
+)
+
+// Files holds the files used by runs of a program so that successive runs
+// can share them, as when each of several files is edited in place. Files
+// written to are opened by the first run writing to them and are not
+// truncated again, while files read by the R command continue where the
+// last run left off.
+type Files struct {
+	m *fileManager
+}
+
+// NewFiles returns an empty Files.
+func NewFiles() *Files {
+	return &Files{m: newFileManager()}
+}
+
+// Close closes all of the files. It returns the first error encountered
+// writing to any of them.
+func (f *Files) Close() error {
+	return f.m.close()
+}
+
+func newFileManager() *fileManager {
+	return &fileManager{
+		readers: make(map[string]*fileReader),
+		writers: make(map[string]*fileWriter),
+	}
+}
+
+// openWriters opens each of the named files for writing. Files are
+// truncated unless appendFile is set. Output to /dev/stdout is handled by
+// the runtime and is not opened here.
+func (m *fileManager) openWriters(names []string, appendFile bool) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendFile {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	for _, name := range names {
+		if _, ok := m.writers[name]; ok || name == stdoutFile {
+			continue
+		}
+		if name == stderrFile {
+			m.writers[name] = &fileWriter{w: bufio.NewWriter(os.Stderr)}
+			continue
+		}
+		f, err := os.OpenFile(name, flag, 0666)
+		if err != nil {
+			return err
+		}
+		m.writers[name] = &fileWriter{f: f, w: bufio.NewWriter(f)}
+	}
+	return nil
+}
+
+// writeLine writes s followed by a newline to the file name, which must
+// have been opened by openWriters.
+func (m *fileManager) writeLine(name, s string) {
+	fw, ok := m.writers[name]
+	if !ok {
+		return
+	}
+	_, err := fw.w.WriteString(s + "\n")
+	if err == nil && fw.f == nil {
+		// Don't hold back output to the standard streams.
+		err = fw.w.Flush()
+	}
+	if err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+// readAll returns the whole content of the file name. A file that can not
+// be read is treated as empty.
+func (m *fileManager) readAll(name string) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// readLine returns the next line of the file name, without its newline.
+// ok is false once the file has been read to the end or if it could not be
+// opened.
+func (m *fileManager) readLine(name string) (line string, ok bool) {
+	fr, found := m.readers[name]
+	if !found {
+		fr = &fileReader{}
+		f, err := os.Open(name)
+		if err != nil {
+			fr.eof = true
+		} else {
+			fr.f = f
+			fr.r = bufio.NewReader(f)
+		}
+		m.readers[name] = fr
+	}
+	if fr.eof {
+		return "", false
+	}
+	line, err := fr.r.ReadString('\n')
+	if err != nil {
+		fr.eof = true
+		if err != io.EOF || len(line) == 0 {
+			return "", false
+		}
+	}
+	return strings.TrimSuffix(line, "\n"), true
+}
+
+// flush writes out what is held back for each of the files written to. It
+// returns the first error encountered writing to any of the files.
+func (m *fileManager) flush() error {
+	for _, fw := range m.writers {
+		if err := fw.w.Flush(); err != nil && m.err == nil {
+			m.err = err
+		}
+	}
+	return m.err
+}
+
+// close closes all of the files opened during the run. It returns the
+// first error encountered writing to any of the files.
+func (m *fileManager) close() error {
+	for _, fr := range m.readers {
+		if fr.f != nil {
+			fr.f.Close()
+		}
+	}
+	for _, fw := range m.writers {
+		err := fw.w.Flush()
+		if fw.f != nil {
+			if cerr := fw.f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil && m.err == nil {
+			m.err = err
+		}
+	}
+	return m.err
+}
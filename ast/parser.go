@@ -3,10 +3,12 @@ package ast
 import (
 	"bytes"
 	"fmt"
-	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/zkry/go-sed/lexer"
+	"github.com/zkry/go-sed/posix"
 	"github.com/zkry/go-sed/token"
 )
 
@@ -16,16 +18,48 @@ type Parser struct {
 	curToken  token.Token
 	peekToken token.Token
 
-	lineCt int
-	errors []string
-	tokens []token.Token
+	src     string
+	offsets []int // The byte offset in src of each character, and of its end.
+	dialect posix.Dialect
+	rangeCt int
+	errors  ErrorList
+	tokens  []token.Token
+
+	zeroRanges []int // The indexes of the 0,/re/ ranges.
+
+	program  *Program     // The program being parsed.
+	blocks   []blockToken // The blocks that are open, innermost last.
+	branches []branchRef  // The branches, resolved once all labels are known.
+	stmtEnd  int          // The offset of the end of the statement last parsed.
+}
+
+// branchRef is a branch to label, found at tok, whose target is set once
+// the program is parsed. An empty label branches to the end of the script.
+type branchRef struct {
+	target *int
+	label  string
+	tok    token.Token
 }
 
-func New(l *lexer.Lexer) *Parser {
+// blockToken is a block that is open, along with the { starting it.
+type blockToken struct {
+	stmt *blockStmt
+	tok  token.Token
+}
+
+// New returns a parser for the program read by l, whose regular
+// expressions are written in the dialect d.
+func New(l *lexer.Lexer, d posix.Dialect) *Parser {
 	p := &Parser{
-		l:      l,
-		errors: []string{},
+		l:       l,
+		src:     l.Input(),
+		dialect: d,
+		errors:  ErrorList{},
+	}
+	for i := range p.src {
+		p.offsets = append(p.offsets, i)
 	}
+	p.offsets = append(p.offsets, len(p.src))
 
 	p.nextToken()
 	p.nextToken()
@@ -36,11 +70,6 @@ func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
 	p.peekToken = p.l.NextToken()
 
-	// Specail next token logic here.
-	if p.curTokenIs(token.NEWLINE) {
-		p.lineCt++
-	}
-
 	p.tokens = append(p.tokens, p.peekToken)
 }
 
@@ -49,34 +78,42 @@ func (p *Parser) nextToken() {
 func (p *Parser) ParseProgram() *Program {
 	program := &Program{}
 	program.Labels = make(map[string]int)
+	program.labelPos = make(map[string]int)
 
 	program.Statements = []statement{}
+	p.program = program
 
 	for p.curToken.Type != token.EOF {
+		start := p.curToken
 		stmt, label := p.parseStatement()
 		if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
+			program.spans = append(program.spans, span{p.startOf(start), p.byteOffset(p.stmtEnd)})
+		}
+		if b, ok := stmt.(*blockStmt); ok {
+			p.blocks = append(p.blocks, blockToken{stmt: b, tok: p.curToken})
 		}
 		if label != "" {
+			if _, ok := program.Labels[label]; ok {
+				p.errorAt(p.curToken, ErrInvalidLabel, fmt.Sprintf("duplicate label `%s'", label))
+			}
 			program.Labels[label] = len(program.Statements)
+			program.labelPos[label] = p.startOf(p.curToken)
 		}
 		p.nextToken()
 	}
+	for _, b := range p.blocks {
+		p.errorAt(b.tok, ErrUnexpectedToken, "unmatched `{'")
+	}
+	p.resolveBranches()
+	program.comments = p.comments()
 	program.Tokens = make([]token.Token, len(p.tokens))
 	copy(program.Tokens, p.tokens)
+	program.rangeCt = p.rangeCt
+	program.zeroRanges = p.zeroRanges
 	return program
 }
 
-type ErrorList []string
-
-func (e ErrorList) Error() string {
-	buff := bytes.Buffer{}
-	for _, err := range e {
-		buff.WriteString(err)
-	}
-	return buff.String()
-}
-
 // Errors returns the list of errors encountered during the parsing process.
 func (p *Parser) Errors() ErrorList {
 	return p.errors
@@ -96,60 +133,41 @@ func (p *Parser) parseStatement() (statement, string) {
 		lit := p.curToken.Literal
 		// Check if valid literal
 		if lit == "" {
-			p.customError("invalid label name")
+			p.errorAt(p.curToken, ErrInvalidLabel, "invalid label name")
 			return nil, ""
 		}
 		return nil, lit
 	}
 
+	if p.curTokenIs(token.RBRACE) {
+		p.closeBlock()
+		p.endStatement()
+		return nil, ""
+	}
+
 	addr := p.parseAddress()
 
 	switch p.curToken.Type {
 	case token.LBRACE:
-		// Start block
-		p.nextToken()
-		block := &Program{}
-		block.Statements = []statement{}
-		block.Labels = map[string]int{}
-		for p.curToken.Type != token.EOF && p.curToken.Type != token.RBRACE {
-			stmt, l := p.parseStatement()
-			if stmt != nil {
-				block.Statements = append(block.Statements, stmt)
-			}
-			if l != "" {
-				block.Labels[l] = len(block.Statements)
-			}
-			p.nextToken()
-		}
-		stmt = &blockStmt{
-			Code:      block,
-			addresser: addr,
-		}
+		// The statements of the block follow it in the program, where it
+		// is closed by the matching }.
+		p.stmtEnd = p.curToken.End
+		return &blockStmt{addresser: addr}, ""
 	case token.CMD:
 		switch p.curToken.Literal {
 		case "a":
-			p.expectPeek(token.BACKSLASH)
-			p.expectPeek(token.LIT)
 			stmt = &aStmt{
 				addresser:  addr,
-				AppendLine: p.curToken.Literal,
+				AppendLine: p.parseText(),
 			}
 		case "b":
-			branchIdent := "$" // TODO: Find better way to signify end.
-			if p.peekTokenIs(token.IDENT) {
-				p.nextToken()
-				branchIdent = p.curToken.Literal
-			}
-			stmt = &bStmt{
-				addresser:   addr,
-				BranchIdent: branchIdent,
-			}
+			b := &bStmt{addresser: addr}
+			b.Label = p.parseBranch(&b.Target)
+			stmt = b
 		case "c":
-			p.expectPeek(token.BACKSLASH)
-			p.expectPeek(token.LIT)
 			stmt = &cStmt{
 				addresser:  addr,
-				ChangeLine: p.curToken.Literal,
+				ChangeLine: p.parseText(),
 			}
 		case "d":
 			stmt = &dStmt{
@@ -160,16 +178,16 @@ func (p *Parser) parseStatement() (statement, string) {
 				addresser: addr,
 			}
 		case "e":
-			// cmd := ""
-			// if p.peekTokenIs(token.LIT) {
-			// 	p.expectPeek(token.LIT)
-			// 	cmd = p.curToken.Literal
-			// }
-			// stmt = &EStmt{
-			// 	Addresser: addr,
-			// 	Command:   cmd,
-			// }
-		case "F": // Is this even a command
+			e := &eStmt{addresser: addr}
+			if p.peekTokenIs(token.IDENT) {
+				p.nextToken()
+				e.Command = p.curToken.Literal
+			}
+			stmt = e
+		case "F":
+			stmt = &fStmt{
+				addresser: addr,
+			}
 		case "g":
 			stmt = &gStmt{
 				addresser: addr,
@@ -187,15 +205,23 @@ func (p *Parser) parseStatement() (statement, string) {
 				addresser: addr,
 			}
 		case "i":
-			p.expectPeek(token.BACKSLASH)
-			p.expectPeek(token.LIT)
 			stmt = &iStmt{
 				addresser:  addr,
-				InsertLine: p.curToken.Literal,
+				InsertLine: p.parseText(),
 			}
 		case "l":
+			width := -1
+			if p.peekTokenIs(token.INT) {
+				p.nextToken()
+				n, err := strconv.Atoi(p.curToken.Literal)
+				if err != nil {
+					p.errorAt(p.curToken, ErrUnexpectedToken, "invalid number "+p.curToken.Literal)
+				}
+				width = n
+			}
 			stmt = &lStmt{
 				addresser: addr,
+				Width:     width,
 			}
 		case "n":
 			stmt = &nStmt{
@@ -214,89 +240,161 @@ func (p *Parser) parseStatement() (statement, string) {
 				addresser: addr,
 			}
 		case "q":
+			p.oneAddress(addr)
 			stmt = &qStmt{
 				addresser: addr,
+				Code:      p.parseExitCode(),
+			}
+		case "Q":
+			p.oneAddress(addr)
+			stmt = &q2Stmt{
+				addresser: addr,
+				Code:      p.parseExitCode(),
 			}
 		case "r":
-			p.expectPeek(token.IDENT)
+			name, ok := p.parseFileName()
+			if !ok {
+				return nil, ""
+			}
 			stmt = &rStmt{
 				addresser: addr,
-				FileName:  p.curToken.Literal,
+				FileName:  name,
 			}
 		case "R":
-			p.expectPeek(token.IDENT)
+			name, ok := p.parseFileName()
+			if !ok {
+				return nil, ""
+			}
 			stmt = &r2Stmt{
 				addresser: addr,
-				FileName:  p.curToken.Literal,
+				FileName:  name,
 			}
 		case "s":
 			fa := ""
 			ra := ""
 			var fl sFlags
-			p.expectPeek(token.DIV)
+			var re posix.Matcher
+			if !p.expectDiv("s") {
+				return nil, ""
+			}
+			faTok := p.peekToken
 			if p.peekTokenIs(token.LIT) {
 				p.expectPeek(token.LIT)
 				fa = p.curToken.Literal
 			}
-			p.expectPeek(token.DIV)
+			if !p.expectDiv("s") {
+				return nil, ""
+			}
 			if p.peekTokenIs(token.LIT) {
 				p.expectPeek(token.LIT)
 				ra = p.curToken.Literal
 			}
-			p.expectPeek(token.DIV)
+			raTok := p.curToken
+			repl, maxGroup := compileReplacement(ra)
+			if !p.expectDiv("s") {
+				return nil, ""
+			}
 			if p.peekTokenIs(token.IDENT) {
 				p.expectPeek(token.IDENT)
-				fl = *p.parseFlags()
+				f := p.parseFlags()
+				if f == nil {
+					return nil, ""
+				}
+				fl = *f
+			}
+			// The regexp can only be compiled once the flags changing how it
+			// matches are known.
+			var flags posix.Flags
+			if fl.IFlag {
+				flags |= posix.IgnoreCase
+			}
+			if fl.MFlag {
+				flags |= posix.Multiline
+			}
+			if fa != "" {
+				re = p.compileRegexp(fa, faTok, flags)
+			} else if flags != 0 {
+				p.errorAt(faTok, ErrInvalidFlag, "cannot specify modifiers on empty regexp")
+			}
+			if re != nil && maxGroup > re.NumSubexp() {
+				msg := fmt.Sprintf("invalid reference \\%d on s command's replacement", maxGroup)
+				p.errorAt(raTok, ErrInvalidReference, msg)
 			}
 			stmt = &sStmt{
 				addresser:   addr,
 				FindAddr:    fa,
+				Regexp:      re,
 				ReplaceAddr: ra,
+				Replacement: repl,
 				Flags:       fl,
 			}
 		case "t":
-			p.expectPeek(token.IDENT)
-			stmt = &tStmt{
-				addresser:   addr,
-				BranchIdent: p.curToken.Literal,
-			}
+			t := &tStmt{addresser: addr}
+			t.Label = p.parseBranch(&t.Target)
+			stmt = t
 		case "T":
-			p.expectPeek(token.IDENT)
-			stmt = &t2Stmt{
+			t := &t2Stmt{addresser: addr}
+			t.Label = p.parseBranch(&t.Target)
+			stmt = t
+		case "v":
+			version := ""
+			if p.peekTokenIs(token.IDENT) {
+				p.nextToken()
+				version = p.curToken.Literal
+				p.checkVersion(version)
+			}
+			stmt = &vStmt{
 				addresser: addr,
-				FileName:  p.curToken.Literal,
+				Version:   version,
 			}
-		case "v":
 		case "w":
-			p.expectPeek(token.IDENT)
+			name, ok := p.parseFileName()
+			if !ok {
+				return nil, ""
+			}
 			stmt = &wStmt{
 				addresser: addr,
-				FileName:  p.curToken.Literal,
+				FileName:  name,
 			}
 		case "W":
-			p.expectPeek(token.IDENT)
+			name, ok := p.parseFileName()
+			if !ok {
+				return nil, ""
+			}
 			stmt = &w2Stmt{
 				addresser: addr,
-				FileName:  p.curToken.Literal,
+				FileName:  name,
 			}
 		case "x":
 			stmt = &xStmt{
 				addresser: addr,
 			}
 		case "y":
-			p.expectPeek(token.DIV)
-			p.expectPeek(token.LIT)
-			fa := p.curToken.Literal
-			p.expectPeek(token.DIV)
-			p.expectPeek(token.LIT)
-			ra := p.curToken.Literal
-			p.expectPeek(token.DIV)
-
-			var err error
-			stmt, err = newYStmt(fa, ra, addr)
+			var fa, ra string
+			if !p.expectDiv("y") {
+				return nil, ""
+			}
+			if p.peekTokenIs(token.LIT) {
+				p.nextToken()
+				fa = p.curToken.Literal
+			}
+			if !p.expectDiv("y") {
+				return nil, ""
+			}
+			if p.peekTokenIs(token.LIT) {
+				p.nextToken()
+				ra = p.curToken.Literal
+			}
+			if !p.expectDiv("y") {
+				return nil, ""
+			}
+
+			y, err := newYStmt(fa, ra, addr)
 			if err != nil {
+				p.errorAt(p.curToken, ErrLengthMismatch, err.Error())
 				return nil, ""
 			}
+			stmt = y
 		case "z":
 			stmt = &zStmt{
 				addresser: addr,
@@ -305,28 +403,265 @@ func (p *Parser) parseStatement() (statement, string) {
 			stmt = &equStmt{
 				addresser: addr,
 			}
+		default:
+			p.errorAt(p.curToken, ErrUnknownCommand, fmt.Sprintf("unknown command: `%s'", p.curToken.Literal))
 		}
 	default:
 		p.unexpectedTokenError()
 	}
 
+	p.endStatement()
+	return stmt, ""
+}
+
+// endStatement moves to the end of the statement just parsed, which must
+// be followed by a delimiter or the } closing a block.
+func (p *Parser) endStatement() {
+	p.stmtEnd = p.curToken.End
+	if p.peekTokenIs(token.RBRACE) {
+		return
+	}
 	p.nextToken()
 	if !p.curToken.IsStatementDelim() {
 		p.unexpectedTokenError()
 	}
+}
 
-	return stmt, ""
+// oneAddress reports an error if addr, the address of the current command,
+// is a range, for the commands that only take a single line address.
+func (p *Parser) oneAddress(addr addresser) {
+	if n, ok := addr.(*notAddr); ok {
+		addr = n.Addr
+	}
+	switch addr.(type) {
+	case *rangeAddress, *zeroRangeAddress, *relRangeAddress, *multRangeAddress:
+		p.errorAt(p.curToken, ErrUnexpectedToken, "command only uses one address")
+	}
+}
+
+// parseExitCode parses the optional exit code of the q and Q commands.
+func (p *Parser) parseExitCode() int {
+	if !p.peekTokenIs(token.INT) {
+		return 0
+	}
+	p.nextToken()
+	code, err := strconv.Atoi(p.curToken.Literal)
+	if err != nil {
+		p.errorAt(p.curToken, ErrUnexpectedToken, "invalid number "+p.curToken.Literal)
+	}
+	return code
+}
+
+// gnuVersion is the version of GNU sed whose behavior is followed. The v
+// command fails to compile when asked for a later one.
+var gnuVersion = []int{4, 9}
+
+// checkVersion reports an error unless version, the current token, is no
+// later than gnuVersion.
+func (p *Parser) checkVersion(version string) {
+	for i, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			p.errorAt(p.curToken, ErrUnexpectedToken, "invalid version "+version)
+			return
+		}
+		have := 0
+		if i < len(gnuVersion) {
+			have = gnuVersion[i]
+		}
+		if n != have {
+			if n > have {
+				p.errorAt(p.curToken, ErrUnexpectedToken, "expected newer version of sed")
+			}
+			return
+		}
+	}
+}
+
+// parseText parses the text of the a, i and c commands, which follows
+// either a backslash and a newline or, as in GNU sed, the command itself on
+// the same line.
+func (p *Parser) parseText() string {
+	if p.peekTokenIs(token.BACKSLASH) {
+		p.nextToken()
+	}
+	p.expectPeek(token.LIT)
+	return p.curToken.Literal
+}
+
+// parseFileName parses the file name of the r, R, w and W commands and of
+// the w flag of s. A missing name is reported, and the rest of the
+// statement is skipped.
+func (p *Parser) parseFileName() (string, bool) {
+	if p.peekTokenIs(token.IDENT) && p.peekToken.Literal != "" {
+		p.nextToken()
+		return p.curToken.Literal, true
+	}
+	p.errorAt(p.peekToken, ErrExpectedToken, "missing filename in r/R/w/W commands")
+	p.skipStatement()
+	return "", false
+}
+
+// expectDiv moves to the divider that must come next in the s or y
+// command cmd. If there is none the command is reported as unterminated,
+// and the rest of the statement is skipped.
+func (p *Parser) expectDiv(cmd string) bool {
+	if p.peekTokenIs(token.DIV) {
+		p.nextToken()
+		return true
+	}
+	p.errorAt(p.peekToken, ErrExpectedToken, fmt.Sprintf("unterminated `%s' command", cmd))
+	p.skipStatement()
+	return false
+}
+
+// skipStatement moves up to the delimiter ending the statement, so that
+// parsing goes on with the next one after an error.
+func (p *Parser) skipStatement() {
+	for !p.peekToken.IsStatementDelim() {
+		p.nextToken()
+	}
+}
+
+// parseBranch parses the label a branch command jumps to, if any, and
+// records target to be set to the statement it names. It returns the
+// label.
+func (p *Parser) parseBranch(target *int) string {
+	label := ""
+	if p.peekTokenIs(token.IDENT) {
+		p.nextToken()
+		label = p.curToken.Literal
+	}
+	p.branches = append(p.branches, branchRef{target: target, label: label, tok: p.curToken})
+	return label
+}
+
+// resolveBranches sets the target of each branch of the program now that
+// all of its labels are known. Branching to a label that is not defined is
+// an error.
+func (p *Parser) resolveBranches() {
+	for _, b := range p.branches {
+		if b.label == "" {
+			*b.target = len(p.program.Statements)
+			continue
+		}
+		target, ok := p.program.Labels[b.label]
+		if !ok {
+			p.errorAt(b.tok, ErrInvalidLabel, fmt.Sprintf("can't find label for jump to `%s'", b.label))
+			continue
+		}
+		*b.target = target
+	}
+}
+
+// closeBlock ends the innermost open block, whose statements are those
+// parsed since it was opened. A matching address jumps past them.
+func (p *Parser) closeBlock() {
+	if len(p.blocks) == 0 {
+		p.errorAt(p.curToken, ErrUnexpectedToken, "unexpected `}'")
+		return
+	}
+	b := p.blocks[len(p.blocks)-1]
+	p.blocks = p.blocks[:len(p.blocks)-1]
+	b.stmt.End = len(p.program.Statements)
+	b.stmt.endPos = p.startOf(p.curToken)
+}
+
+// byteOffset returns the byte offset in the script of the character at
+// offset i, as the offsets of tokens count characters.
+func (p *Parser) byteOffset(i int) int {
+	return p.offsets[clamp(i, len(p.offsets)-1)]
+}
+
+// startOf returns the byte offset in the script of tok, less the blanks
+// skipped before it.
+func (p *Parser) startOf(tok token.Token) int {
+	start, end := p.byteOffset(tok.Start), p.byteOffset(tok.End)
+	for start < end && (p.src[start] == ' ' || p.src[start] == '\t') {
+		start++
+	}
+	return start
+}
+
+// comments returns the comments of the script, which the lexer turns into
+// newline tokens.
+func (p *Parser) comments() []comment {
+	var comments []comment
+	for _, tok := range p.tokens {
+		pos := p.startOf(tok)
+		if tok.Type != token.NEWLINE || pos >= len(p.src) || p.src[pos] != '#' {
+			continue
+		}
+		text := p.src[pos:p.byteOffset(tok.End)]
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = text[:i]
+		}
+		before := strings.TrimRight(p.src[:pos], " \t;")
+		comments = append(comments, comment{
+			Text:     strings.TrimRight(text, " \t"),
+			Pos:      pos,
+			Trailing: before != "" && !strings.HasSuffix(before, "\n"),
+		})
+	}
+
+	// Blank lines are kept as comments with no text, unless they are part
+	// of a statement, as in the text of the a command.
+	pos := 0
+	for _, l := range strings.SplitAfter(p.src, "\n") {
+		if strings.TrimSpace(l) == "" && !p.inStatement(pos) {
+			comments = append(comments, comment{Pos: pos})
+		}
+		pos += len(l)
+	}
+	sort.SliceStable(comments, func(i, j int) bool {
+		return comments[i].Pos < comments[j].Pos
+	})
+	return comments
+}
+
+// inStatement reports whether the line at the byte offset pos of the
+// script is part of a statement parsed so far. A statement ending right at
+// pos, such as the text of the a command, ends with that line.
+func (p *Parser) inStatement(pos int) bool {
+	for _, s := range p.program.spans {
+		if s.Start <= pos && pos <= s.End {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *Parser) parseAddress() addresser {
-	if p.curTokenIs(token.CMD) {
+	if p.curTokenIs(token.CMD) || p.curTokenIs(token.LBRACE) {
 		return &blankAddress{}
 	}
 
+	addrTok := p.curToken
 	addr1 := p.parseAddressPart()
 	if addr1 == nil {
 		return nil
 	}
+	if p.curTokenIs(token.TILDE) {
+		first, ok := addr1.(*lineNoAddr)
+		if !ok {
+			p.unexpectedTokenError()
+			return nil
+		}
+		step, ok := p.parseStep()
+		if !ok {
+			return nil
+		}
+		// Like line 0, 0~0 would never match.
+		if first.LineNo == 0 && step == 0 {
+			p.errorAt(addrTok, ErrUnexpectedToken, "invalid usage of line address 0")
+			return nil
+		}
+		addr1 = &stepAddr{First: first.LineNo, Step: step}
+	}
+	if p.curToken.Type != token.COMMA && isLineZero(addr1) {
+		p.errorAt(addrTok, ErrUnexpectedToken, "invalid usage of line address 0")
+		return nil
+	}
 	switch p.curToken.Type {
 	case token.CMD:
 		return addr1
@@ -334,8 +669,10 @@ func (p *Parser) parseAddress() addresser {
 		return addr1
 	case token.COMMA:
 		p.nextToken()
-		addr2 := p.parseAddressPart()
-		rangeAddr := &rangeAddress{Addr1: addr1, Addr2: addr2}
+		rangeAddr := p.parseRange(addr1, addrTok)
+		if rangeAddr == nil {
+			return nil
+		}
 		if p.curToken.Type == token.EXPLMARK {
 			p.nextToken()
 			return &notAddr{Addr: rangeAddr}
@@ -351,22 +688,118 @@ func (p *Parser) parseAddress() addresser {
 	return nil
 }
 
+// parseRange parses the second address of a range, the current token
+// being its start, and returns the range from addr1, found at addrTok.
+func (p *Parser) parseRange(addr1 addresser, addrTok token.Token) addresser {
+	index := p.rangeCt
+	p.rangeCt++
+	switch p.curToken.Type {
+	case token.PLUS, token.TILDE:
+		if isLineZero(addr1) {
+			p.errorAt(addrTok, ErrUnexpectedToken, "invalid usage of line address 0")
+			return nil
+		}
+		op := p.curToken.Type
+		n, ok := p.parseStep()
+		if !ok {
+			return nil
+		}
+		if op == token.PLUS {
+			return &relRangeAddress{Addr1: addr1, N: n, index: index}
+		}
+		return &multRangeAddress{Addr1: addr1, N: n, index: index}
+	}
+
+	addr2 := p.parseAddressPart()
+	if addr2 == nil {
+		return nil
+	}
+	if isLineZero(addr1) {
+		if _, ok := addr2.(*regexpAddr); !ok {
+			p.errorAt(addrTok, ErrUnexpectedToken, "invalid usage of line address 0")
+			return nil
+		}
+		p.zeroRanges = append(p.zeroRanges, index)
+		return &zeroRangeAddress{Addr2: addr2, index: index}
+	}
+	return &rangeAddress{Addr1: addr1, Addr2: addr2, index: index}
+}
+
+// parseStep parses the number following the current token, a + or ~ in an
+// address, and moves past it.
+func (p *Parser) parseStep() (int, bool) {
+	if !p.expectPeek(token.INT) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(p.curToken.Literal)
+	if err != nil {
+		// As for a line number, parsing goes on with the largest number.
+		p.errorAt(p.curToken, ErrUnexpectedToken, "invalid number "+p.curToken.Literal)
+	}
+	p.nextToken()
+	return n, true
+}
+
+// isLineZero reports whether addr is line 0, which may only start a range
+// ended by a regexp.
+func isLineZero(addr addresser) bool {
+	a, ok := addr.(*lineNoAddr)
+	return ok && a.LineNo == 0
+}
+
+// parseFlags parses the flags of an s command, the first of which is the
+// current token. Each flag may be given once, and w, taking the rest of
+// the line as its file name, ends them. It returns nil if the file name of
+// w is missing.
 func (p *Parser) parseFlags() *sFlags {
 	flg := &sFlags{}
+	seen := map[string]bool{}
 	for {
-		if p.curToken.Literal[0] >= '1' && p.curToken.Literal[0] <= '9' {
-			flg.NFlag = int(p.curToken.Literal[0] - '0')
-		} else if p.curToken.Literal == "g" {
+		lit := p.curToken.Literal
+		name := lit
+		if lit[0] >= '0' && lit[0] <= '9' {
+			name = "number"
+		} else if lit == "i" || lit == "m" {
+			name = strings.ToUpper(lit)
+		}
+		if seen[name] {
+			if name == "number" {
+				p.errorAt(p.curToken, ErrInvalidFlag, "multiple number options to `s' command")
+			} else {
+				p.errorAt(p.curToken, ErrInvalidFlag, fmt.Sprintf("multiple `%s' options to `s' command", name))
+			}
+		}
+		seen[name] = true
+
+		switch name {
+		case "number":
+			n, err := strconv.Atoi(lit)
+			if err != nil {
+				p.errorAt(p.curToken, ErrInvalidFlag, "invalid number option to `s' command")
+			} else if n == 0 {
+				p.errorAt(p.curToken, ErrInvalidFlag, "number option to `s' command may not be zero")
+			}
+			flg.NFlag = n
+		case "g":
 			flg.GFlag = true
-		} else if p.curToken.Literal == "p" {
+		case "p":
 			flg.PFlag = true
-		} else if p.curToken.Literal == "w" {
-			if p.expectPeek(token.IDENT) {
-				flg.WFile = p.curToken.Literal
-			} else {
-				p.unexpectedTokenError()
+			flg.PExec = !flg.EFlag
+		case "e":
+			flg.EFlag = true
+		case "I":
+			flg.IFlag = true
+		case "M":
+			flg.MFlag = true
+		case "w":
+			name, ok := p.parseFileName()
+			if !ok {
+				return nil
 			}
+			flg.WFile = name
 			return flg // No more flags after this.
+		default:
+			p.unexpectedFlagError([]rune(lit)[0])
 		}
 		if !p.peekTokenIs(token.IDENT) {
 			return flg
@@ -375,68 +808,75 @@ func (p *Parser) parseFlags() *sFlags {
 	}
 }
 
-// translateLiteral performs the translation from user input
-// to the string that shoudl be processed in the regexp. This
-// incluedes processing escape characters.
-func translateLiteral(l string) string {
+// translateLiteral removes the backslash from an escaped div, the
+// character delimiting the regexp, which stands for itself. All other
+// escape sequences are left for the regexp to interpret.
+func translateLiteral(l string, div rune) string {
 	var retData bytes.Buffer
 	var escState bool
 	for _, r := range l {
 		if escState {
-			switch {
-			case r == '\\':
+			if r != div {
 				retData.WriteRune('\\')
-			case r == 'n':
-				retData.WriteRune('\n')
-				// TODO: Check case of the literal that was used to divide
-			default:
-				// TODO: Error
 			}
+			retData.WriteRune(r)
 			escState = false
+		} else if r == '\\' {
+			escState = true
 		} else {
-			switch {
-			case r == '\\':
-				escState = true
-			default:
-				retData.WriteRune(r)
-			}
+			retData.WriteRune(r)
 		}
 	}
+	if escState {
+		retData.WriteRune('\\')
+	}
 	return retData.String()
 }
+
+// compileRegexp compiles pattern, found in the token tok, in the dialect
+// of the parser with the given flags. Invalid patterns are reported as
+// errors.
+func (p *Parser) compileRegexp(pattern string, tok token.Token, flags posix.Flags) posix.Matcher {
+	re, err := posix.Compile(pattern, p.dialect, flags)
+	if err != nil {
+		p.errorAt(tok, ErrInvalidRegexp, "invalid regexp: "+err.Error())
+		return nil
+	}
+	return re
+}
+
 func (p *Parser) parseAddressPart() addresser {
 	var addr addresser
 	switch p.curToken.Type {
 	case token.SLASH:
+		div := []rune(p.curToken.Literal)[0]
 		if !p.peekTokenIs(token.LIT) {
 			// Could be a blank literal
 			if p.peekTokenIs(token.SLASH) {
 				p.nextToken()
-				regex := regexp.MustCompile("")
-				addr = &regexpAddr{Regexp: regex}
+				if p.parseAddrFlags() != 0 {
+					p.errorAt(p.curToken, ErrInvalidFlag, "cannot specify modifiers on empty regexp")
+				}
+				addr = &regexpAddr{}
 				break
 			}
 			return nil
 		}
 		p.nextToken()
 
-		lit := p.curToken.Literal
+		lit, litTok := p.curToken.Literal, p.curToken
 		if !p.expectPeek(token.SLASH) {
 			return nil
 		}
-		// TODO: Should have own form of regexp
-		lit = translateLiteral(lit)
-		regex, err := regexp.Compile(lit)
-		if err != nil {
-			regex = regexp.MustCompile(".*")
-		}
-
-		addr = &regexpAddr{Regexp: regex}
+		flags := p.parseAddrFlags()
+		regex := p.compileRegexp(translateLiteral(lit, div), litTok, flags)
+		addr = &regexpAddr{Regexp: regex, Pattern: translateLiteral(lit, div), Flags: flags}
 	case token.INT:
+		// A number out of range is reported, and parsing goes on with
+		// the largest number, which Atoi returns.
 		i, err := strconv.Atoi(p.curToken.Literal)
 		if err != nil {
-			// TODO: Have a better way of doing error handling
-			panic(err)
+			p.errorAt(p.curToken, ErrUnexpectedToken, "invalid number "+p.curToken.Literal)
 		}
 		addr = &lineNoAddr{LineNo: i}
 	case token.DOLLAR:
@@ -448,6 +888,24 @@ func (p *Parser) parseAddressPart() addresser {
 	return addr
 }
 
+// parseAddrFlags parses the I and M modifiers following a regexp address,
+// leaving the last of them as the current token.
+func (p *Parser) parseAddrFlags() posix.Flags {
+	var flags posix.Flags
+	for p.peekTokenIs(token.IDENT) {
+		p.nextToken()
+		switch p.curToken.Literal {
+		case "I":
+			flags |= posix.IgnoreCase
+		case "M":
+			flags |= posix.Multiline
+		default:
+			p.unexpectedFlagError([]rune(p.curToken.Literal)[0])
+		}
+	}
+	return flags
+}
+
 func (p *Parser) curTokenIs(t token.Type) bool {
 	return p.curToken.Type == t
 }
@@ -465,25 +923,22 @@ func (p *Parser) expectPeek(t token.Type) bool {
 	return false
 }
 
-func (p *Parser) lineNumber() int {
-	return p.lineCt + 1
+// errorAt records an error pointing at tok.
+func (p *Parser) errorAt(tok token.Token, code ErrorCode, msg string) {
+	p.errors = append(p.errors, newCompileError(p.src, tok, code, msg))
 }
 
 func (p *Parser) peekError(t token.Type) {
-	msg := fmt.Sprintf("line %d: expected next token to be %s, got %s instead", p.lineNumber(), t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	msg := fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type)
+	p.errorAt(p.peekToken, ErrExpectedToken, msg)
 }
 
 func (p *Parser) unexpectedTokenError() {
-	msg := fmt.Sprintf("line %d: unexpected token type %s", p.lineNumber(), p.curToken.Type)
-	p.errors = append(p.errors, msg)
+	msg := fmt.Sprintf("unexpected token type %s", p.curToken.Type)
+	p.errorAt(p.curToken, ErrUnexpectedToken, msg)
 }
 
 func (p *Parser) unexpectedFlagError(f rune) {
-	msg := fmt.Sprintf("line %d: unexpected flag type %v", p.lineNumber(), f)
-	p.errors = append(p.errors, msg)
-}
-
-func (p *Parser) customError(f string) {
-	p.errors = append(p.errors, f)
+	msg := fmt.Sprintf("unexpected flag type %c", f)
+	p.errorAt(p.curToken, ErrInvalidFlag, msg)
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/zkry/go-sed/lexer"
+	"github.com/zkry/go-sed/posix"
 )
 
 func TestStatement(t *testing.T) {
@@ -18,10 +19,42 @@ func TestStatement(t *testing.T) {
 		{program: "s/1/2/", isError: false},
 		{program: "s//2/", isError: false},
 		{program: "s/2//", isError: false},
+		{program: "s/a/\\1/", isError: true},
+		{program: "s/\\(a\\)/\\1&/", isError: false},
+		{program: "T", isError: false},
+		{program: "Tlabel", isError: false},
+		{program: "z", isError: false},
+		{program: "F", isError: false},
+		{program: "q 5", isError: false},
+		{program: "Q", isError: false},
+		{program: "Q2", isError: false},
+		{program: "v", isError: false},
+		{program: "v 4.2", isError: false},
+		{program: "v 9.0", isError: true},
+		{program: "v x", isError: true},
+		{program: "e", isError: false},
+		{program: "e echo hi; echo there", isError: false},
+		{program: "l", isError: false},
+		{program: "l 20", isError: false},
+		{program: "l0", isError: false},
+		{program: "1{p}", isError: false},
+		{program: "1{2{p};p}", isError: false},
+		{program: "1!{p}", isError: false},
+		{program: "s/a/b/3g", isError: false},
+		{program: "s/a/b/12", isError: false},
+		{program: "s/a/b/Ig", isError: false},
+		{program: "s/a/b/mpe", isError: false},
+		{program: "s/a/b/0", isError: true},
+		{program: "s/a/b/gg", isError: true},
+		{program: "s/a/b/2p3", isError: true},
+		{program: "s/a/b/iI", isError: true},
+		{program: "s/a/b/x", isError: true},
+		{program: "s//b/I", isError: true},
 		{program: "a\\\ntext", isError: false},
-		{program: "a text", isError: true},
+		{program: "a text", isError: false},
+		{program: "a", isError: true},
 		{program: "btext", isError: false},
-		{program: "b", isError: true},
+		{program: "b", isError: false},
 		{program: "c\\\ntext", isError: false},
 		{program: "/addr/d", isError: false},
 		{program: "/a/,/b/ d", isError: false},
@@ -35,8 +68,15 @@ func TestStatement(t *testing.T) {
 		{program: "h", isError: false},
 		{program: "H", isError: false},
 		{program: "/what/q", isError: false},
+		{program: "1!q", isError: false},
+		{program: "1,2q", isError: true},
+		{program: "1,2!q", isError: true},
+		{program: "/a/,+2Q", isError: true},
+		{program: "0,/a/Q", isError: true},
+		{program: "1,~2q 5", isError: true},
 		{program: "tlabel", isError: false},
 		{program: "y/abc/def/", isError: false},
+		{program: "y/abc/de/", isError: true},
 		{program: "n", isError: false},
 		{program: "N", isError: false},
 		{program: "i\\\ntext", isError: false},
@@ -49,7 +89,7 @@ func TestStatement(t *testing.T) {
 
 	for i, test := range tests {
 		l := lexer.New(test.program)
-		p := New(l)
+		p := New(l, posix.BRE)
 		_, _ = p.parseStatement()
 		if len(p.Errors()) > 0 && !test.isError {
 			t.Errorf("Stmt [%d] %s failed: expected no error, got %v\n", i, test.program, p.Errors())
@@ -58,7 +98,7 @@ func TestStatement(t *testing.T) {
 		}
 	}
 	// l := lexer.New(input)
-	// p := New(l)
+	// p := New(l, posix.BRE)
 
 	// stmt := p.parseStatement()
 	// pretty.Println(stmt)
@@ -85,14 +125,21 @@ func TestParse(t *testing.T) {
 		{program: "s/one/two/\n\ns/two/three/;", isError: false},
 		{program: "\ns/one/two/\n\ns/two/three/\n", isError: false},
 		{program: "/quit_now/q", isError: false},
+		{program: "1{2{p}\n}", isError: false},
+		{program: "1{p", isError: true},
+		{program: "p}", isError: true},
+		{program: "1{p}}", isError: true},
 	}
 	for i, test := range tests {
 		l := lexer.New(test.program)
-		p := New(l)
+		p := New(l, posix.BRE)
 		_ = p.ParseProgram()
 		if !test.isError && len(p.errors) > 0 {
 			t.Errorf("Program [%d] %s expected no errors but got: %v", i, test.program, p.errors)
 		}
+		if test.isError && len(p.errors) == 0 {
+			t.Errorf("Program [%d] %s expected an error", i, test.program)
+		}
 		// if test.ast != nil {
 		// 	if !cmp.Equal(ast, test.ast) {
 		// 		t.Errorf("Program [%d] %s ast tree not equal to expected result", i, test.program)
@@ -162,8 +209,8 @@ func TestRun(t *testing.T) {
 			input:   "This is a word.",
 			output:  "This is b word.",
 		},
-		{ // TODO: Change to traditional Sed syntax
-			program: "s/This is a (.*)\\./$1/",
+		{
+			program: "s/This is a \\(.*\\)\\./\\1/",
 			input:   "This is a word.",
 			output:  "word",
 		},
@@ -282,7 +329,7 @@ N
 D
 `,
 			input:  "line1\nline2\nline3\nline4",
-			output: "line1",
+			output: "line1\nline4",
 		},
 		{
 			program: `
@@ -311,6 +358,26 @@ s/here/HERE/
 			input:   "START\nhere2\nhere3\nhere4\nEND",
 			output:  "CHANGE",
 		},
+		{
+			program: `a x\ty\nz\\`,
+			input:   "1",
+			output:  "1\nx\ty\nz\\",
+		},
+		{
+			program: "1a hello\n$i\\  two\n2c  changed",
+			input:   "1\n2",
+			output:  "1\nhello\n  two\nchanged",
+		},
+		{
+			program: `N;y/\n/X/`,
+			input:   "a\nb",
+			output:  "aXb",
+		},
+		{
+			program: `y/b\\\//\n|X/`,
+			input:   "ab\\c/",
+			output:  "a\n|cX",
+		},
 	}
 
 	opt := RuntimeOptions{
@@ -323,7 +390,7 @@ s/here/HERE/
 		fmt.Printf("======= test %d =======\n", i)
 		fmt.Printf("=======================\n")
 		l := lexer.New(tt.program)
-		p := New(l)
+		p := New(l, posix.BRE)
 		program := p.ParseProgram()
 		if len(p.errors) > 0 {
 			t.Errorf("Program [%d] %s encountered errors %v", i, tt.program, p.errors)
@@ -335,3 +402,313 @@ s/here/HERE/
 		}
 	}
 }
+
+func TestAddress(t *testing.T) {
+	tests := []struct {
+		program string
+		output  string
+		isError bool
+	}{
+		{program: "0~3p", output: "3\n6\n9"},
+		{program: "2~3p", output: "2\n5\n8"},
+		{program: "5~0p", output: "5"},
+		{program: "2,+2p", output: "2\n3\n4"},
+		{program: "/4/,+0p", output: "4"},
+		{program: "5,~4p", output: "5\n6\n7\n8"},
+		{program: "8,~4p", output: "8\n9\n10"},
+		{program: "2,~0p", output: "2"},
+		{program: "/1/,~5p", output: "1\n2\n3\n4\n5\n10"},
+		{program: "0,/1/p", output: "1"},
+		{program: "1,/1/p", output: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10"},
+		{program: "0,/3/p", output: "1\n2\n3"},
+		{program: "0~4,+1p", output: "4\n5\n8\n9"},
+		{program: "/X/I,+1p", output: ""},
+		{program: "s/1/A/;/a/Ip", output: "A\nA0"},
+		{program: "s/5/x\\ny/;/^y/Mp", output: "x\ny"},
+		{program: "0p", isError: true},
+		{program: "0,5p", isError: true},
+		{program: "0,+1p", isError: true},
+		{program: "/a/,~p", isError: true},
+		{program: "$~2p", isError: true},
+		{program: "0~0p", isError: true},
+		{program: "0~0,5p", isError: true},
+		{program: "//Ip", isError: true},
+		{program: "99999999999999999999p", isError: true},
+		{program: "1,99999999999999999999p", isError: true},
+	}
+
+	input := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10"
+	for i, tt := range tests {
+		p := New(lexer.New(tt.program), posix.BRE)
+		program := p.ParseProgram()
+		if tt.isError {
+			if len(p.errors) == 0 {
+				t.Errorf("Program [%d] %s expected an error", i, tt.program)
+			}
+			continue
+		}
+		if len(p.errors) > 0 {
+			t.Errorf("Program [%d] %s encountered errors %v", i, tt.program, p.errors)
+			continue
+		}
+		out := program.Run(input, RuntimeOptions{})
+		if out != tt.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n Expected: %q\n Got: %q\n", i, tt.program, tt.output, out)
+		}
+	}
+}
+
+// TestExitCode checks the exit code parsed for q and Q.
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		program string
+		code    int
+	}{
+		{program: "q", code: 0},
+		{program: "q 5", code: 5},
+		{program: "$q7", code: 7},
+		{program: "Q 3", code: 3},
+	}
+
+	for i, tt := range tests {
+		p := New(lexer.New(tt.program), posix.BRE)
+		program := p.ParseProgram()
+		if len(p.errors) > 0 || len(program.Statements) != 1 {
+			t.Errorf("Program [%d] %s encountered errors %v", i, tt.program, p.errors)
+			continue
+		}
+		var code int
+		switch s := program.Statements[0].(type) {
+		case *qStmt:
+			code = s.Code
+		case *q2Stmt:
+			code = s.Code
+		}
+		if code != tt.code {
+			t.Errorf("Program [%d] %s: expected exit code %d, got %d", i, tt.program, tt.code, code)
+		}
+	}
+}
+
+// TestProgramString checks that programs are written out in canonical
+// form, and that the result parses back into the same program.
+func TestProgramString(t *testing.T) {
+	tests := []struct {
+		program string
+		output  string
+	}{
+		{program: "p", output: "p\n"},
+		{program: "1d;$p", output: "1 d\n$ p\n"},
+		{program: "2!{h;/x/I,+3G}", output: "2! {\n  h\n  /x/I,+3 G\n}\n"},
+		{program: "1{2{p}}", output: "1 {\n  2 {\n    p\n  }\n}\n"},
+		{program: ":a;N;$!ba", output: ":a\nN\n$! b a\n"},
+		{program: "p;:end", output: "p\n:end\n"},
+		{program: "s|a/b|c|2gpI", output: "s/a\\/b/c/2gpI\n"},
+		{program: `s,a\,b,\n,w out.txt`, output: "s/a,b/\\n/w out.txt\n"},
+		{program: `\%a/b%p`, output: "/a\\/b/ p\n"},
+		{program: "y/abc/xyz/", output: "y/abc/xyz/\n"},
+		{program: `s,[^/]*/,[/],;\:[]/]:p`, output: "s/[^/]*\\//[\\/]/\n/[]/]/ p\n"},
+		{program: "0,/x/d;1~2p;3,~4l 5", output: "0,/x/ d\n1~2 p\n3,~4 l 5\n"},
+		{program: "q;Q 4;l", output: "q\nQ 4\nl\n"},
+		{program: "a\\\nfoo\\\nbar", output: "a\\\nfoo\\\nbar\n"},
+		{program: "1{i\\\nx\n}", output: "1 {\n  i\\\nx\n}\n"},
+		{program: "# top\np # print\n\n\n{ # block\n\n# inside\nd;# delete\n\n}\n# end\n",
+			output: "# top\np # print\n\n{ # block\n  # inside\n  d # delete\n}\n# end\n"},
+		{program: "b x;# jump\n:x\nw out.txt", output: "b x\n# jump\n:x\nw out.txt\n"},
+		{program: "a\\\nfoo\\\n\np", output: "a\\\nfoo\\\n\np\n"},
+		{program: `i foo\tbar\\`, output: "i\\\nfoo\\tbar\\\\\n"},
+	}
+
+	for i, tt := range tests {
+		p := New(lexer.New(tt.program), posix.BRE)
+		program := p.ParseProgram()
+		if len(p.errors) > 0 {
+			t.Errorf("Program [%d] %s encountered errors %v", i, tt.program, p.errors)
+			continue
+		}
+		out := program.String()
+		if out != tt.output {
+			t.Errorf("Program [%d] %s written incorrectly.\n Expected: %q\n Got: %q\n", i, tt.program, tt.output, out)
+			continue
+		}
+		p = New(lexer.New(out), posix.BRE)
+		if again := p.ParseProgram().String(); len(p.errors) > 0 || again != out {
+			t.Errorf("Program [%d] %s did not parse back the same, got %q, errors %v", i, tt.program, again, p.errors)
+		}
+	}
+}
+
+// TestRangeAddress checks ranges against the output of GNU sed, including
+// ranges whose start or end is read over by n.
+func TestRangeAddress(t *testing.T) {
+	tests := []struct {
+		program string
+		output  string
+	}{
+		{program: "2,4p", output: "2\n3\n4"},
+		{program: "2,1p", output: "2"},
+		{program: "3,3p", output: "3"},
+		{program: "$,3p", output: "10"},
+		{program: "/[27]/,4p", output: "2\n3\n4\n7"},
+		{program: "/2/,/[0-9]/p", output: "2\n3"},
+		{program: "/8/,/x/p", output: "8\n9\n10"},
+		{program: "2,4p;2,4p", output: "2\n2\n3\n3\n4\n4"},
+		{program: "2,4p;3n;3n", output: "2\n3"},
+		{program: "2,4p;2n;3n;4n", output: "2"},
+		{program: "/1/,3p;1n;2n;3n", output: "1\n10"},
+		{program: "/2/,/4/p;2n;3n;4n", output: "2\n6\n7\n8\n9\n10"},
+		{program: "2,/4/p;2n;3n;4n", output: "2\n6\n7\n8\n9\n10"},
+		{program: "4,$p;3n", output: "5\n6\n7\n8\n9\n10"},
+		{program: "4,+2p;3n", output: "5\n6\n7"},
+		{program: "4,~4p;3n", output: "5\n6\n7\n8"},
+		{program: "4,6p;3n;5n;6n;7n", output: "5"},
+		{program: "N;0,/x/p", output: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10"},
+		{program: "N;0,/4/p", output: "1\n2\n3\n4"},
+		{program: "0,/1/p;0,/3/p", output: "1\n1\n2\n3"},
+	}
+
+	input := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10"
+	for i, tt := range tests {
+		p := New(lexer.New(tt.program), posix.BRE)
+		program := p.ParseProgram()
+		if len(p.errors) > 0 {
+			t.Errorf("Program [%d] %s encountered errors %v", i, tt.program, p.errors)
+			continue
+		}
+		// A second run must not see the ranges left open by the first.
+		for run := 0; run < 2; run++ {
+			out := program.Run(input, RuntimeOptions{})
+			if out != tt.output {
+				t.Errorf("Program [%d] %s run %d produced incorrect output.\n Expected: %q\n Got: %q\n", i, tt.program, run, tt.output, out)
+			}
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	tests := []struct {
+		program string
+		line    int
+		column  int
+		start   int
+		code    ErrorCode
+		render  string
+	}{
+		{
+			program: "p\n1,x p",
+			line:    2,
+			column:  3,
+			start:   4,
+			code:    ErrUnexpectedToken,
+			render:  "2:3: unexpected token type ILLEGAL\n\t1,x p\n\t  ^\n",
+		},
+		{
+			program: "p;\t:",
+			line:    1,
+			column:  5,
+			start:   4,
+			code:    ErrExpectedToken,
+			render:  "1:5: expected next token to be IDENTIFIER, got EOF instead\n\tp;\t:\n\t  \t ^\n",
+		},
+		{
+			program: "s/é/e/\n1,é p",
+			line:    2,
+			column:  3,
+			start:   10,
+			code:    ErrUnexpectedToken,
+			render:  "2:3: unexpected token type ILLEGAL\n\t1,é p\n\t  ^\n",
+		},
+		{
+			program: "p\nb foo",
+			line:    2,
+			column:  3,
+			start:   4,
+			code:    ErrInvalidLabel,
+			render:  "2:3: can't find label for jump to `foo'\n\tb foo\n\t  ^^^\n",
+		},
+		{
+			program: ":a\n1{:b\n}\n:a",
+			line:    4,
+			column:  2,
+			start:   11,
+			code:    ErrInvalidLabel,
+			render:  "4:2: duplicate label `a'\n\t:a\n\t ^\n",
+		},
+		{
+			program: "y/ab/\\n/",
+			line:    1,
+			column:  8,
+			start:   7,
+			code:    ErrLengthMismatch,
+			render:  "1:8: strings for `y' command are different lengths\n\ty/ab/\\n/\n\t       ^\n",
+		},
+		{
+			program: "p;k",
+			line:    1,
+			column:  3,
+			start:   2,
+			code:    ErrUnknownCommand,
+			render:  "1:3: unknown command: `k'\n\tp;k\n\t  ^\n",
+		},
+		{
+			program: "1r\np",
+			line:    1,
+			column:  3,
+			start:   2,
+			code:    ErrExpectedToken,
+			render:  "1:3: missing filename in r/R/w/W commands\n\t1r\n\t  ^\n",
+		},
+		{
+			program: "s/a/b",
+			line:    1,
+			column:  6,
+			start:   5,
+			code:    ErrExpectedToken,
+			render:  "1:6: unterminated `s' command\n\ts/a/b\n\t     ^\n",
+		},
+	}
+
+	for i, tt := range tests {
+		p := New(lexer.New(tt.program), posix.BRE)
+		p.ParseProgram()
+		errs := p.Errors()
+		if len(errs) == 0 {
+			t.Errorf("Program [%d] %q: expected an error and got none", i, tt.program)
+			continue
+		}
+		err := errs[0]
+		if err.Line != tt.line || err.Column != tt.column || err.Start != tt.start || err.Code != tt.code {
+			t.Errorf("Program [%d] %q: expected %d:%d at %d with code %s, got %d:%d at %d with code %s",
+				i, tt.program, tt.line, tt.column, tt.start, tt.code, err.Line, err.Column, err.Start, err.Code)
+		}
+		if got := err.Render(); got != tt.render {
+			t.Errorf("Program [%d] %q: expected rendering %q, got %q", i, tt.program, tt.render, got)
+		}
+	}
+}
+
+// TestSingleError checks that a statement cut short is reported once, and
+// that parsing goes on with the next statement.
+func TestSingleError(t *testing.T) {
+	tests := []struct {
+		program string
+		msg     string
+	}{
+		{"r", "missing filename in r/R/w/W commands"},
+		{"1W \np", "missing filename in r/R/w/W commands"},
+		{"s/a/b/w\np", "missing filename in r/R/w/W commands"},
+		{"s", "unterminated `s' command"},
+		{"s/a\np", "unterminated `s' command"},
+		{"y/a", "unterminated `y' command"},
+		{"1{y/a/b\n}", "unterminated `y' command"},
+	}
+
+	for i, tt := range tests {
+		p := New(lexer.New(tt.program), posix.BRE)
+		p.ParseProgram()
+		errs := p.Errors()
+		if len(errs) != 1 || errs[0].Msg != tt.msg {
+			t.Errorf("Program [%d] %q: expected the single error %q, got %v", i, tt.program, tt.msg, errs)
+		}
+	}
+}
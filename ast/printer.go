@@ -0,0 +1,413 @@
+package ast
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zkry/go-sed/posix"
+)
+
+// span is the part of the script a statement was parsed from, as byte
+// offsets.
+type span struct {
+	Start, End int
+}
+
+// comment is a comment of the script, kept so that the program can be
+// written back out with it. A comment with no text stands for a blank
+// line, so that the blank lines separating parts of the script are kept
+// too.
+type comment struct {
+	Text     string // The comment, from the # to the end of its line.
+	Pos      int    // The offset of the # in the script.
+	Trailing bool   // Whether the comment follows a command on its line.
+}
+
+// line is a line of a program written out as a script.
+type line struct {
+	depth   int
+	text    string
+	pos     int    // Where what the line holds is in the script.
+	inner   int    // The depth of a comment coming before the line.
+	open    bool   // Whether the line ends in an argument running to the end of the line.
+	comment string // A comment following the line.
+}
+
+// String returns the program written out as a script in canonical form:
+// one command per line, with the commands of blocks indented by two spaces
+// and the operands of the s and y commands and of regexp addresses
+// delimited by slashes. The comments of the script are kept where they
+// were, except that a comment following a command whose argument runs to
+// the end of the line is moved to a line of its own.
+func (p *Program) String() string {
+	var lines []line
+	comments := p.comments
+	for _, l := range append(p.lines(), line{pos: int(^uint(0) >> 1)}) {
+		for len(comments) > 0 && comments[0].Pos < l.pos {
+			c := comments[0]
+			comments = comments[1:]
+			last := len(lines) - 1
+			switch {
+			case c.Text == "":
+				// Blank lines are kept one at a time, and never at the
+				// start of the script or of a block.
+				if last >= 0 && lines[last].text != "" && !strings.HasSuffix(lines[last].text, "{") {
+					lines = append(lines, line{open: true})
+				}
+			case c.Trailing && last >= 0 && !lines[last].open && lines[last].comment == "":
+				lines[last].comment = c.Text
+			default:
+				lines = append(lines, line{depth: l.inner, text: c.Text, open: true})
+			}
+		}
+		// Nor are they kept at the end of the script or of a block.
+		if last := len(lines) - 1; last >= 0 && lines[last].text == "" && (l.text == "" || l.text == "}") {
+			lines = lines[:last]
+		}
+		if l.text != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(strings.Repeat("  ", l.depth))
+		b.WriteString(l.text)
+		if l.comment != "" {
+			b.WriteString(" " + l.comment)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// lines returns the lines of the program written out as a script, without
+// its comments.
+func (p *Program) lines() []line {
+	var lines []line
+	depths := p.depths()
+	labels := p.labelsAt()
+	closing := p.blockEnds()
+	for i := 0; i <= len(p.Statements); i++ {
+		for _, b := range closing[i] {
+			depth := depths[b]
+			lines = append(lines, line{depth: depth, text: "}", pos: p.Statements[b].(*blockStmt).endPos, inner: depth + 1})
+		}
+		for _, label := range labels[i] {
+			lines = append(lines, line{depth: depths[i], text: ":" + label, pos: p.labelPos[label], inner: depths[i], open: true})
+		}
+		if i < len(p.Statements) {
+			s := p.Statements[i]
+			l := line{depth: depths[i], text: stmtString(s), inner: depths[i], open: endsInArg(s)}
+			if i < len(p.spans) {
+				l.pos = p.spans[i].Start
+			}
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// depths returns how many blocks each statement is nested in, with an
+// extra entry for the end of the program.
+func (p *Program) depths() []int {
+	depths := make([]int, len(p.Statements)+1)
+	var open []int // The ends of the open blocks.
+	for i, s := range p.Statements {
+		for len(open) > 0 && open[len(open)-1] <= i {
+			open = open[:len(open)-1]
+		}
+		depths[i] = len(open)
+		if b, ok := s.(*blockStmt); ok {
+			open = append(open, b.End)
+		}
+	}
+	return depths
+}
+
+// blockEnds returns the indices of the blocks closed before each
+// statement, innermost first, with an extra entry for the end of the
+// program.
+func (p *Program) blockEnds() [][]int {
+	ends := make([][]int, len(p.Statements)+1)
+	for i := len(p.Statements) - 1; i >= 0; i-- {
+		if b, ok := p.Statements[i].(*blockStmt); ok {
+			ends[b.End] = append(ends[b.End], i)
+		}
+	}
+	return ends
+}
+
+// labelsAt returns the labels before each statement, in the order they
+// appear in the script, with an extra entry for the end of the program.
+func (p *Program) labelsAt() [][]string {
+	labels := make([][]string, len(p.Statements)+1)
+	for label, i := range p.Labels {
+		labels[i] = append(labels[i], label)
+	}
+	for _, l := range labels {
+		sort.Slice(l, func(i, j int) bool {
+			if p.labelPos[l[i]] != p.labelPos[l[j]] {
+				return p.labelPos[l[i]] < p.labelPos[l[j]]
+			}
+			return l[i] < l[j]
+		})
+	}
+	return labels
+}
+
+// endsInArg reports whether the statement s ends in an argument that runs
+// to the end of the line, such as a file name, so that nothing can follow
+// it on its line.
+func endsInArg(s statement) bool {
+	switch s := s.(type) {
+	case *aStmt, *bStmt, *cStmt, *eStmt, *iStmt, *rStmt, *r2Stmt, *tStmt, *t2Stmt, *vStmt, *wStmt, *w2Stmt:
+		return true
+	case *sStmt:
+		return s.Flags.WFile != ""
+	}
+	return false
+}
+
+// stmtString returns the statement s as it would be written in a script,
+// with its address.
+func stmtString(s statement) string {
+	a, cmd := stmtParts(s)
+	addr := addrString(a)
+	if addr != "" {
+		addr += " "
+	}
+	return addr + cmd
+}
+
+// stmtParts returns the address of the statement s and its command as it
+// would be written in a script.
+func stmtParts(s statement) (addresser, string) {
+	switch s := s.(type) {
+	case *aStmt:
+		return s.addresser, "a\\\n" + quoteText(s.AppendLine)
+	case *bStmt:
+		return s.addresser, withArg("b", s.Label)
+	case *cStmt:
+		return s.addresser, "c\\\n" + quoteText(s.ChangeLine)
+	case *dStmt:
+		return s.addresser, "d"
+	case *d2Stmt:
+		return s.addresser, "D"
+	case *eStmt:
+		return s.addresser, withArg("e", s.Command)
+	case *fStmt:
+		return s.addresser, "F"
+	case *gStmt:
+		return s.addresser, "g"
+	case *g2Stmt:
+		return s.addresser, "G"
+	case *hStmt:
+		return s.addresser, "h"
+	case *h2Stmt:
+		return s.addresser, "H"
+	case *iStmt:
+		return s.addresser, "i\\\n" + quoteText(s.InsertLine)
+	case *lStmt:
+		if s.Width < 0 {
+			return s.addresser, "l"
+		}
+		return s.addresser, "l " + strconv.Itoa(s.Width)
+	case *nStmt:
+		return s.addresser, "n"
+	case *n2Stmt:
+		return s.addresser, "N"
+	case *pStmt:
+		return s.addresser, "p"
+	case *p2Stmt:
+		return s.addresser, "P"
+	case *qStmt:
+		return s.addresser, withCode("q", s.Code)
+	case *q2Stmt:
+		return s.addresser, withCode("Q", s.Code)
+	case *rStmt:
+		return s.addresser, withArg("r", s.FileName)
+	case *r2Stmt:
+		return s.addresser, withArg("R", s.FileName)
+	case *sStmt:
+		return s.addresser, "s/" + quoteRegexp(s.FindAddr) + "/" + quotePattern(s.ReplaceAddr) + "/" + s.Flags.String()
+	case *tStmt:
+		return s.addresser, withArg("t", s.Label)
+	case *t2Stmt:
+		return s.addresser, withArg("T", s.Label)
+	case *vStmt:
+		return s.addresser, withArg("v", s.Version)
+	case *wStmt:
+		return s.addresser, withArg("w", s.FileName)
+	case *w2Stmt:
+		return s.addresser, withArg("W", s.FileName)
+	case *xStmt:
+		return s.addresser, "x"
+	case *yStmt:
+		return s.addresser, "y/" + quotePattern(s.Find) + "/" + quotePattern(s.Replace) + "/"
+	case *zStmt:
+		return s.addresser, "z"
+	case *equStmt:
+		return s.addresser, "="
+	case *blockStmt:
+		return s.addresser, "{"
+	}
+	return nil, ""
+}
+
+func withArg(cmd, arg string) string {
+	if arg == "" {
+		return cmd
+	}
+	return cmd + " " + arg
+}
+
+func withCode(cmd string, code int) string {
+	if code == 0 {
+		return cmd
+	}
+	return cmd + " " + strconv.Itoa(code)
+}
+
+// String returns the flags as they are written after an s command.
+func (f sFlags) String() string {
+	var b strings.Builder
+	if f.NFlag != 0 {
+		b.WriteString(strconv.Itoa(f.NFlag))
+	}
+	if f.GFlag {
+		b.WriteByte('g')
+	}
+	switch {
+	case f.PFlag && f.EFlag && f.PExec:
+		b.WriteString("pe")
+	case f.PFlag && f.EFlag:
+		b.WriteString("ep")
+	case f.PFlag:
+		b.WriteByte('p')
+	case f.EFlag:
+		b.WriteByte('e')
+	}
+	if f.IFlag {
+		b.WriteByte('I')
+	}
+	if f.MFlag {
+		b.WriteByte('M')
+	}
+	if f.WFile != "" {
+		b.WriteString("w " + f.WFile)
+	}
+	return b.String()
+}
+
+// addrString returns the address a as it would be written in a script.
+func addrString(a addresser) string {
+	switch a := a.(type) {
+	case *lineNoAddr:
+		return strconv.Itoa(a.LineNo)
+	case *eofAddr:
+		return "$"
+	case *regexpAddr:
+		s := "/" + quoteRegexp(a.Pattern) + "/"
+		if a.Flags&posix.IgnoreCase != 0 {
+			s += "I"
+		}
+		if a.Flags&posix.Multiline != 0 {
+			s += "M"
+		}
+		return s
+	case *notAddr:
+		return addrString(a.Addr) + "!"
+	case *stepAddr:
+		return strconv.Itoa(a.First) + "~" + strconv.Itoa(a.Step)
+	case *rangeAddress:
+		return addrString(a.Addr1) + "," + addrString(a.Addr2)
+	case *zeroRangeAddress:
+		return "0," + addrString(a.Addr2)
+	case *relRangeAddress:
+		return addrString(a.Addr1) + ",+" + strconv.Itoa(a.N)
+	case *multRangeAddress:
+		return addrString(a.Addr1) + ",~" + strconv.Itoa(a.N)
+	}
+	return ""
+}
+
+// quotePattern returns an operand of the s or y command, or a regexp
+// address, as written between / delimiters. Escapes are kept as they are,
+// while slashes and newlines are escaped.
+func quotePattern(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			b.WriteByte(c)
+			i++
+			b.WriteByte(s[i])
+		case c == '/', c == '\n':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// quoteRegexp is like quotePattern for a regexp, whose bracket expressions
+// are kept as they are, as a slash does not end one.
+func quoteRegexp(s string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexAny(s, "[\\")
+		if i < 0 || i+1 >= len(s) {
+			break
+		}
+		if s[i] == '\\' {
+			b.WriteString(quotePattern(s[:i+2]))
+			s = s[i+2:]
+			continue
+		}
+		end := i + bracketLen(s[i:])
+		b.WriteString(quotePattern(s[:i]))
+		b.WriteString(s[i:end])
+		s = s[end:]
+	}
+	b.WriteString(quotePattern(s))
+	return b.String()
+}
+
+// bracketLen returns the length of the bracket expression s starts with,
+// or the length of s if the expression is unterminated.
+func bracketLen(s string) int {
+	i := 1
+	if strings.HasPrefix(s[i:], "^") {
+		i++
+	}
+	if strings.HasPrefix(s[i:], "]") {
+		i++
+	}
+	for i < len(s) {
+		switch {
+		case s[i] == ']':
+			return i + 1
+		case s[i] == '[' && i+1 < len(s) && strings.IndexByte(":=.", s[i+1]) >= 0:
+			end := strings.Index(s[i+2:], string(s[i+1])+"]")
+			if end < 0 {
+				return len(s)
+			}
+			i += 2 + end + 2
+		default:
+			i++
+		}
+	}
+	return len(s)
+}
+
+// quoteText returns the text of the a, i or c command as written after
+// a\ and a newline, with its control characters escaped.
+func quoteText(s string) string {
+	r := strings.NewReplacer("\\", "\\\\", "\n", "\\\n", "\t", `\t`, "\r", `\r`,
+		"\f", `\f`, "\v", `\v`, "\a", `\a`)
+	return r.Replace(s)
+}
@@ -0,0 +1,172 @@
+package ast
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// replacement is the compiled replacement of an s command. Each part is
+// literal text, a reference to the text matched by a group, the whole
+// match being group 0, or a change to the case of the text that follows.
+type replacement []replacePart
+
+type partKind int
+
+const (
+	literalPart partKind = iota
+	groupPart
+	casePart
+)
+
+// caseConv is a case conversion started by one of the escapes \U, \L, \u,
+// \l and \E.
+type caseConv int
+
+const (
+	convNone       caseConv = iota // \E, ending \U or \L
+	convUpper                      // \U
+	convLower                      // \L
+	convUpperFirst                 // \u
+	convLowerFirst                 // \l
+)
+
+type replacePart struct {
+	kind    partKind
+	literal string
+	group   int
+	conv    caseConv
+}
+
+// compileReplacement compiles the replacement text of an s command:
+//
+//	&        the whole match
+//	\1 - \9  the text matched by the nth group, \0 being the whole match
+//	\n       a newline, along with \t, \r, \f, \v and \a
+//	\U, \L   turn the text that follows to upper or lower case
+//	\u, \l   turn the next character to upper or lower case
+//	\E       stop the conversion started by \U or \L
+//	\c       the character c, so \& and \\ stand for & and \
+//
+// Any other character, including $, stands for itself. It also returns the
+// highest group referred to.
+func compileReplacement(text string) (replacement, int) {
+	var repl replacement
+	var lit strings.Builder
+	maxGroup := 0
+	add := func(part replacePart) {
+		if lit.Len() > 0 {
+			repl = append(repl, replacePart{kind: literalPart, literal: lit.String()})
+			lit.Reset()
+		}
+		repl = append(repl, part)
+		if part.kind == groupPart && part.group > maxGroup {
+			maxGroup = part.group
+		}
+	}
+
+	rs := []rune(text)
+	for i := 0; i < len(rs); i++ {
+		c := rs[i]
+		if c == '&' {
+			add(replacePart{kind: groupPart})
+			continue
+		}
+		if c != '\\' || i+1 == len(rs) {
+			lit.WriteRune(c)
+			continue
+		}
+		i++
+		switch c = rs[i]; c {
+		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			add(replacePart{kind: groupPart, group: int(c - '0')})
+		case 'U':
+			add(replacePart{kind: casePart, conv: convUpper})
+		case 'L':
+			add(replacePart{kind: casePart, conv: convLower})
+		case 'u':
+			add(replacePart{kind: casePart, conv: convUpperFirst})
+		case 'l':
+			add(replacePart{kind: casePart, conv: convLowerFirst})
+		case 'E':
+			add(replacePart{kind: casePart, conv: convNone})
+		case 'n':
+			lit.WriteRune('\n')
+		case 't':
+			lit.WriteRune('\t')
+		case 'r':
+			lit.WriteRune('\r')
+		case 'f':
+			lit.WriteRune('\f')
+		case 'v':
+			lit.WriteRune('\v')
+		case 'a':
+			lit.WriteRune('\a')
+		default:
+			lit.WriteRune(c)
+		}
+	}
+	if lit.Len() > 0 {
+		repl = append(repl, replacePart{kind: literalPart, literal: lit.String()})
+	}
+	return repl, maxGroup
+}
+
+// expand writes the replacement for the match m of src to buff. Groups
+// that did not take part in the match are replaced by nothing.
+func (repl replacement) expand(buff *bytes.Buffer, src string, m []int) {
+	w := caseWriter{buff: buff}
+	for _, part := range repl {
+		switch part.kind {
+		case literalPart:
+			w.write(part.literal)
+		case groupPart:
+			if 2*part.group+1 < len(m) && m[2*part.group] >= 0 {
+				w.write(src[m[2*part.group]:m[2*part.group+1]])
+			}
+		case casePart:
+			switch part.conv {
+			case convUpperFirst, convLowerFirst:
+				w.first = part.conv
+			default:
+				// As in GNU sed, \L, \U and \E cancel a conversion of
+				// the first character that has not been made yet.
+				w.conv = part.conv
+				w.first = convNone
+			}
+		}
+	}
+}
+
+// caseWriter writes text converted to the case asked for. A conversion of
+// the first character waits for the next text that is not empty.
+type caseWriter struct {
+	buff  *bytes.Buffer
+	conv  caseConv // convNone, convUpper or convLower
+	first caseConv // convNone, convUpperFirst or convLowerFirst
+}
+
+func (w *caseWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	if w.first != convNone {
+		r, size := utf8.DecodeRuneInString(s)
+		if w.first == convUpperFirst {
+			w.buff.WriteRune(unicode.ToUpper(r))
+		} else {
+			w.buff.WriteRune(unicode.ToLower(r))
+		}
+		w.first = convNone
+		s = s[size:]
+	}
+	switch w.conv {
+	case convUpper:
+		w.buff.WriteString(strings.ToUpper(s))
+	case convLower:
+		w.buff.WriteString(strings.ToLower(s))
+	default:
+		w.buff.WriteString(s)
+	}
+}
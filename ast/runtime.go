@@ -1,17 +1,25 @@
 package ast
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
 	"strings"
+
+	"github.com/zkry/go-sed/posix"
 )
 
 type directives struct {
-	nextCmd       bool
 	deleteCmd     bool
 	restartScript bool // Used for the 'D' command
 	quitCmd       bool
 	quitNoPattern bool
-	runBlock      *Program
-	jumpTo        string
+	quitSilent    bool // Quit without printing the pattern space or appended text, for Q.
+	jump          bool // Whether to continue at jumpTo rather than the next statement.
+	jumpTo        int
 }
 
 type runtime struct {
@@ -19,123 +27,485 @@ type runtime struct {
 	holdSpace    string
 	appendSpace  string
 	lineNo       int
-	lines        []string
+	input        *lineReader
+	files        *fileManager
+	chomped      bool // Whether the current line was terminated by a newline.
 	program      *Program
+	options      RuntimeOptions
 	output       string
+	out          io.Writer // Where the output of the cycle being run goes.
+	writeErr     error     // The first error writing to out.
+	searchErr    error     // The first error of a regexp search, which ends the run.
+	missingNL    bool      // Whether the last output is waiting on a newline.
 	directives   directives
 	subMade      bool
+	ranges       []rangeState // The state of each range address, by index.
+	lastRegexp   posix.Matcher
+	result       Result     // What the run has done so far, including the exit code given to q or Q.
+	trace        []StmtInfo // A description of each statement, if the run is traced.
 }
 
 type RuntimeOptions struct {
-	AllowExec      bool
-	AutoPrint      bool
-	AppendFile     bool
-	DefaultRuntime *runtime
-	IsBlock        bool
-	LineNoStart    int
+	AllowExec  bool // Whether commands may be run by the e flag of s, which is ignored otherwise.
+	AutoPrint  bool
+	AppendFile bool
+	LineLength int    // The width the l command wraps its output at, 0 for no wrapping.
+	Posix      bool   // Whether to follow POSIX where GNU sed differs, as with POSIXLY_CORRECT.
+	InputName  string // The name printed by the F command if the input is not NamedInput, - if empty.
+	State      *State // If set, the run continues from and updates State.
+	Files      *Files // If set, the files used are taken from Files and left open at the end of the run.
+	Tracer     Tracer // If set, told about each step of the run.
+}
+
+// State is the part of a run that carries over from one input line to the
+// next: the hold space, the line number and which ranges are active. All
+// of it lives outside of the Program so that a Program can be run by many
+// goroutines at once. Passing the same State to successive runs makes each
+// one continue where the last left off.
+type State struct {
+	holdSpace string
+	lineNo    int
+	ranges    []rangeState
+}
+
+// Result describes a finished run of a program.
+type Result struct {
+	LinesRead    int   // The number of lines of input read.
+	LinesWritten int   // The number of lines of output written, not counting files.
+	BytesWritten int64 // The number of bytes of output written, not counting files.
+	Quit         bool  // Whether the run was stopped by q or Q.
+	ExitCode     int   // The exit code given to q or Q, 0 if there was none.
+	Err          error // The first I/O error of the run, or a regexp search giving up, if any.
+}
+
+// rangeState is the state of a range address during a run.
+type rangeState struct {
+	active  bool
+	end     int  // The last line of a range whose end is known when it starts.
+	started bool // Whether the range has started, for one starting at a line number.
+}
+
+// NamedInput is input made up of named parts, such as several files read
+// one after the other. Given NamedInput, the F command prints the name of
+// the part the current line was read from.
+type NamedInput interface {
+	io.Reader
+	// NameAt returns the name of the part holding the byte at offset,
+	// which has already been read.
+	NameAt(offset int64) string
+}
+
+// lineReader reads input one line at a time. The next line is always read
+// ahead of time so that it is known whether the current line is the last.
+type lineReader struct {
+	r           *bufio.Reader
+	named       NamedInput // The input if it is named, otherwise nil.
+	offset      int64      // The number of bytes of input read as lines.
+	next        string
+	nextChomped bool
+	nextName    string
+	hasNext     bool
+	name        string // The name of the part of the input holding the current line.
+	err         error
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	lr := &lineReader{r: bufio.NewReader(r)}
+	lr.named, _ = r.(NamedInput)
+	lr.advance()
+	return lr
+}
+
+func (lr *lineReader) advance() {
+	line, err := lr.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		lr.err = err
+	}
+	lr.hasNext = len(line) > 0
+	lr.nextChomped = strings.HasSuffix(line, "\n")
+	lr.next = strings.TrimSuffix(line, "\n")
+	if lr.named != nil && lr.hasNext {
+		lr.nextName = lr.named.NameAt(lr.offset)
+	}
+	lr.offset += int64(len(line))
+}
+
+// readLine returns the next line of input without its newline, reporting
+// whether the line had one. ok is false when there is no more input.
+func (lr *lineReader) readLine() (line string, chomped bool, ok bool) {
+	if !lr.hasNext {
+		return "", false, false
+	}
+	line, chomped, lr.name = lr.next, lr.nextChomped, lr.nextName
+	lr.advance()
+	return line, chomped, true
+}
+
+// isLast reports whether the line last returned by readLine is the last
+// line of input.
+func (lr *lineReader) isLast() bool {
+	return !lr.hasNext
+}
+
+// readLine reads the next line of input, flushing anything queued for
+// output at the end of the current line first. ok is false when there is
+// no more input.
+func (r *runtime) readLine() (line string, ok bool) {
+	r.flushAppend()
+	line, chomped, ok := r.input.readLine()
+	if !ok {
+		return "", false
+	}
+	r.lineNo++
+	r.result.LinesRead++
+	r.chomped = chomped
+	return line, true
+}
+
+// useRegexp returns the regexp to match with, re, recording it as the last
+// one used. If re is nil, the empty regexp, the last one used is returned.
+func (r *runtime) useRegexp(re posix.Matcher) posix.Matcher {
+	if re == nil {
+		return r.lastRegexp
+	}
+	r.lastRegexp = re
+	return re
+}
+
+// write adds s to the output, ending the previous line of output first if
+// its newline was held back.
+func (r *runtime) write(s string) {
+	if r.missingNL {
+		r.output += "\n"
+		r.missingNL = false
+	}
+	r.output += s
+}
+
+// writeLine adds s to the output as a line. If the current line of input
+// was not terminated by a newline, the newline is held back and only
+// written if more output follows.
+func (r *runtime) writeLine(s string) {
+	r.write(s)
+	if r.chomped {
+		r.output += "\n"
+	} else {
+		r.missingNL = true
+	}
+}
+
+// flushAppend writes out the text queued to be output at the end of the
+// current line.
+func (r *runtime) flushAppend() {
+	if len(r.appendSpace) > 0 {
+		r.write(r.appendSpace)
+		r.appendSpace = ""
+	}
+}
+
+// flush writes the output so far to out. Once writing has failed,
+// the output is dropped.
+func (r *runtime) flush() {
+	if r.writeErr != nil {
+		r.output = ""
+		return
+	}
+	n, err := io.WriteString(r.out, r.output)
+	r.result.BytesWritten += int64(n)
+	r.result.LinesWritten += strings.Count(r.output[:n], "\n")
+	r.output = ""
+	r.writeErr = err
+}
+
+// searchFailed records err, the error of a regexp search that gave up. The
+// run ends after the current cycle, as the search could not tell whether
+// there was a match.
+func (r *runtime) searchFailed(err error) {
+	if r.searchErr == nil {
+		r.searchErr = fmt.Errorf("line %d: %v", r.lineNo, err)
+	}
 }
 
+// tracer returns the tracer of the run, or nil if it is not traced. The
+// output so far is written out first so that it comes before whatever the
+// tracer writes.
+func (r *runtime) tracer() Tracer {
+	t := r.options.Tracer
+	if t != nil {
+		r.flush()
+	}
+	return t
+}
+
+// Run runs the program over text, treating it as lines separated by
+// newlines, and returns the output without its final newline.
 func (p *Program) Run(text string, options RuntimeOptions) string {
-	// TODO: Setup runtime flags
-	// Create runtime
+	var out bytes.Buffer
+	p.Exec(context.Background(), strings.NewReader(text+"\n"), &out, options)
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// Exec runs the program over the lines read from in. The output of each
+// cycle is written to out as soon as the cycle finishes, so input of any
+// size can be processed. Exec stops early if ctx is done, with the
+// context's error as the result's Err.
+func (p *Program) Exec(ctx context.Context, in io.Reader, out io.Writer, options RuntimeOptions) Result {
+	s := p.NewStepper(in, options)
+	for {
+		if err := ctx.Err(); err != nil {
+			s.finish(err)
+			break
+		}
+		if !s.Step(out) {
+			break
+		}
+	}
+	return s.Close()
+}
+
+// newRanges returns the state of the ranges of the program at the start of
+// a run, in which only the 0,/re/ ranges are active.
+func (p *Program) newRanges() []rangeState {
+	ranges := make([]rangeState, p.rangeCt)
+	for _, i := range p.zeroRanges {
+		ranges[i].active = true
+	}
+	return ranges
+}
+
+// Stepper runs a program over its input one cycle at a time, exactly as
+// Exec does, so that the pattern and hold space can be looked at in
+// between.
+type Stepper struct {
+	p    *Program
+	r    *runtime
+	done bool // Whether the run has finished.
+}
+
+// NewStepper returns a Stepper for a run of the program over the lines
+// read from in.
+func (p *Program) NewStepper(in io.Reader, options RuntimeOptions) *Stepper {
 	r := &runtime{
 		program: p,
-		lines:   strings.Split(text, "\n"),
+		input:   newLineReader(in),
+		files:   newFileManager(),
+		options: options,
+		ranges:  p.newRanges(),
 	}
-	if options.DefaultRuntime != nil {
-		r = options.DefaultRuntime
-		r.directives = directives{}
+	if options.Files != nil {
+		r.files = options.Files.m
 	}
+	if options.Tracer != nil {
+		r.trace = p.StmtInfos()
+	}
+	if st := options.State; st != nil {
+		r.holdSpace = st.holdSpace
+		r.lineNo = st.lineNo
+		if st.ranges != nil {
+			copy(r.ranges, st.ranges)
+		}
+	}
+	s := &Stepper{p: p, r: r}
+	if err := r.files.openWriters(p.outputFiles(), options.AppendFile); err != nil {
+		if options.Files == nil {
+			r.files.close()
+		}
+		r.result.Err = err
+		s.done = true
+	}
+	return s
+}
 
-	retStr := ""
-
-lineLoop:
-	for r.lineNo = options.LineNoStart; r.lineNo < len(r.lines); r.lineNo++ {
-		// fmt.Printf("\n\nline[%d]=%s\n", r.lineNo, r.lines[r.lineNo])
+// Step runs the next cycle and writes its output to out. It returns false
+// if there was no cycle left to run, because the input is exhausted, the
+// program quit or an error occurred.
+func (s *Stepper) Step(out io.Writer) bool {
+	if s.done {
+		return false
+	}
+	r := s.r
+	r.out = out
+	line, ok := r.readLine()
+	if !ok {
+		s.finish(r.input.err)
+		return false
+	}
+	r.patternSpace = line
+	r.subMade = false
+	if t := r.tracer(); t != nil {
+		t.StartCycle(r.lineNo, r.patternSpace, r.holdSpace)
+	}
+	quit := s.p.runCycle(r)
+	if r.searchErr != nil {
+		// What the cycle output may be wrong.
 		r.output = ""
-		r.patternSpace = r.lines[r.lineNo]
-		r.subMade = false
-		pc := 0
-		for pc < len(p.Statements) {
-			s := p.Statements[pc]
-			// fmt.Printf("Running statement[%d]: %T\n", pc, s)
-			match := s.Address(r)
-			if !match {
-				pc++
-				continue
-			}
-			s.Run(r)
-			if r.directives.nextCmd {
-				// fmt.Println("[D] nextCmd")
-				// Proceed to the next line printing out current pattern space.
-				r.directives.nextCmd = false
-				if options.AutoPrint {
-					r.output += r.patternSpace + "\n"
-				}
-				retStr += r.output
-				continue lineLoop
-			} else if r.directives.deleteCmd {
-				// fmt.Println("[D] deleteCmd")
-				// Proceed to the next line not printing out current pattern space.
-				r.directives.deleteCmd = false
-				retStr += r.output
-				continue lineLoop
-			} else if r.directives.quitCmd {
-				// fmt.Println("[D] quitCmd")
-				r.directives.quitCmd = false
-				// Quit the program with the rest of the pattern space.
-				retStr += r.output
-				retStr += r.patternSpace
-				return retStr
-			} else if r.directives.quitNoPattern {
-				// fmt.Println("[D] quit No Pattern")
-				r.directives.quitNoPattern = false
-				// Quit the program with the rest of the output.
-				retStr += r.output
-				return retStr
-			} else if r.directives.runBlock != nil {
-				// fmt.Println("[D] runBlock")
-				opt := options
-				opt.DefaultRuntime = r
-				opt.IsBlock = true
-				opt.LineNoStart = r.lineNo
-
-				r.output = r.directives.runBlock.Run("", opt)
-
-				// fmt.Println("exiting block statement")
-				// fmt.Println("  opt.dr.output=", opt.DefaultRuntime.output)
-				// fmt.Println("  r.output=", r.output)
-			} else if r.directives.jumpTo != "" {
-				// fmt.Println("[D] jumpTo")
-				label := r.directives.jumpTo
-				r.directives.jumpTo = ""
-				// fmt.Printf("Jumping to %s@%d\n", label, p.Labels[label])
-				pc = p.Labels[label]
-				continue
-			} else if r.directives.restartScript {
-				// fmt.Println("[D] restartScript")
-				r.directives.restartScript = false
-				pc = 0
-				continue
+	}
+	r.flush()
+	switch {
+	case r.writeErr != nil:
+		s.finish(r.writeErr)
+	case r.searchErr != nil:
+		s.finish(r.searchErr)
+	case quit:
+		r.result.Quit = true
+		s.finish(r.input.err)
+	}
+	return true
+}
+
+// LineNo returns the number of the line last read.
+func (s *Stepper) LineNo() int {
+	return s.r.lineNo
+}
+
+// PatternSpace returns the pattern space as the last cycle left it.
+func (s *Stepper) PatternSpace() string {
+	return s.r.patternSpace
+}
+
+// HoldSpace returns the hold space.
+func (s *Stepper) HoldSpace() string {
+	return s.r.holdSpace
+}
+
+// Close ends the run, whether or not all of the cycles were run, and
+// returns its result.
+func (s *Stepper) Close() Result {
+	if !s.done {
+		s.finish(nil)
+	}
+	return s.r.result
+}
+
+// finish ends the run because of err, which may be nil, saving the state
+// and closing the files written to, or flushing them if they are shared.
+func (s *Stepper) finish(err error) {
+	r := s.r
+	s.done = true
+	if st := r.options.State; st != nil {
+		st.holdSpace = r.holdSpace
+		st.lineNo = r.lineNo
+		st.ranges = r.ranges
+	}
+	closeFiles := r.files.close
+	if r.options.Files != nil {
+		closeFiles = r.files.flush
+	}
+	if cerr := closeFiles(); err == nil {
+		err = cerr
+	}
+	r.result.Err = err
+}
+
+// jump makes execution continue at the statement with the index pc.
+func (r *runtime) jump(pc int) {
+	r.directives.jump = true
+	r.directives.jumpTo = pc
+}
+
+// shell runs cmd with the shell and returns its output. ok is false if
+// the options do not allow commands to be run, in which case nothing is.
+func (r *runtime) shell(cmd string) (out string, ok bool) {
+	if !r.options.AllowExec {
+		return "", false
+	}
+	b, _ := exec.Command("sh", "-c", cmd).Output()
+	return string(b), true
+}
+
+// execPatternSpace runs the pattern space as a command and replaces it
+// with the output, less the trailing newline.
+func (r *runtime) execPatternSpace() {
+	if out, ok := r.shell(r.patternSpace); ok {
+		r.patternSpace = strings.TrimSuffix(out, "\n")
+	}
+}
+
+// writeFile writes s as a line to the file name. Writing to /dev/stdout
+// adds to the program's regular output.
+func (r *runtime) writeFile(name, s string) {
+	if name == stdoutFile {
+		r.writeLine(s)
+		return
+	}
+	r.files.writeLine(name, s)
+}
+
+// outputFiles returns the names of all the files written to by the
+// program.
+func (p *Program) outputFiles() []string {
+	var names []string
+	for _, s := range p.Statements {
+		switch s := s.(type) {
+		case *wStmt:
+			names = append(names, s.FileName)
+		case *w2Stmt:
+			names = append(names, s.FileName)
+		case *sStmt:
+			if s.Flags.WFile != "" {
+				names = append(names, s.Flags.WFile)
 			}
-			pc++
 		}
-		if options.AutoPrint && !options.IsBlock {
-			r.output += r.patternSpace + "\n"
+	}
+	return names
+}
+
+// runCycle runs the script against the pattern space and performs the
+// end of cycle output. It returns true if the program should stop.
+func (p *Program) runCycle(r *runtime) bool {
+	for !p.execute(r) && r.directives.restartScript {
+		r.directives.restartScript = false
+	}
+	d := r.directives
+	r.directives = directives{}
+	if t := r.tracer(); t != nil {
+		t.EndCycle(r.patternSpace, r.holdSpace)
+	}
+
+	if d.quitSilent {
+		return true
+	}
+	if r.options.AutoPrint && !d.deleteCmd && !d.quitNoPattern {
+		r.writeLine(r.patternSpace)
+	}
+	r.flushAppend()
+	return d.quitCmd || d.quitNoPattern
+}
+
+// execute runs the statements of p against the pattern space. It returns
+// false if a statement ended the cycle before the end of the script.
+func (p *Program) execute(r *runtime) bool {
+	pc := 0
+	for pc < len(p.Statements) {
+		s := p.Statements[pc]
+		match := s.Address(r)
+		if t := r.tracer(); t != nil {
+			t.Address(r.trace[pc], match)
+		}
+		if !match {
+			if b, ok := s.(*blockStmt); ok {
+				pc = b.End
+			} else {
+				pc++
+			}
+			continue
 		}
-		// fmt.Printf("  output=%s\n", r.output)
-		retStr += r.output
-		if len(r.appendSpace) > 0 {
-			retStr += r.appendSpace
-			r.appendSpace = ""
+		s.Run(r)
+		if t := r.tracer(); t != nil {
+			t.Exec(r.trace[pc], r.patternSpace, r.holdSpace)
 		}
-		if options.IsBlock {
-			return retStr
+		if r.directives.deleteCmd || r.directives.quitCmd || r.directives.quitNoPattern ||
+			r.directives.quitSilent || r.directives.restartScript {
+			return false
+		} else if r.directives.jump {
+			r.directives.jump = false
+			if t := r.tracer(); t != nil {
+				t.Branch(r.trace[pc], r.directives.jumpTo)
+			}
+			pc = r.directives.jumpTo
+			continue
 		}
+		pc++
 	}
-	if len(retStr) > 0 && retStr[len(retStr)-1] == '\n' && !options.IsBlock {
-		retStr = retStr[0 : len(retStr)-1]
-	}
-	// fmt.Println("⏎ returning")
-	return retStr
+	return true
 }
@@ -0,0 +1,46 @@
+package ast
+
+// Tracer is told about each step of a run as it happens, to debug a
+// program. It is set in RuntimeOptions. Before each call, the output of
+// the run so far is written out, so that what a Tracer writes alongside
+// the output comes in the order it happened.
+type Tracer interface {
+	// StartCycle is called when the line lineNo has been read into the
+	// pattern space, before the script is run.
+	StartCycle(lineNo int, pattern, hold string)
+	// Address is called when the address of a statement has been checked,
+	// with whether it matched.
+	Address(stmt StmtInfo, matched bool)
+	// Exec is called when a statement has run, with the pattern and hold
+	// space it left.
+	Exec(stmt StmtInfo, pattern, hold string)
+	// Branch is called when a statement makes execution continue at the
+	// statement with the index target, which is the number of statements
+	// for the end of the script.
+	Branch(stmt StmtInfo, target int)
+	// EndCycle is called when the script is done with the pattern space,
+	// before it is printed.
+	EndCycle(pattern, hold string)
+}
+
+// StmtInfo describes a statement of a program.
+type StmtInfo struct {
+	Index      int    // The index of the statement in the program.
+	Start, End int    // Where the statement is in the script, as byte offsets.
+	Depth      int    // The number of blocks the statement is in.
+	Text       string // The statement as written by Program.String.
+}
+
+// StmtInfos returns a description of each statement of the program, by
+// index.
+func (p *Program) StmtInfos() []StmtInfo {
+	depths := p.depths()
+	infos := make([]StmtInfo, len(p.Statements))
+	for i, s := range p.Statements {
+		infos[i] = StmtInfo{Index: i, Depth: depths[i], Text: stmtString(s)}
+		if i < len(p.spans) {
+			infos[i].Start, infos[i].End = p.spans[i].Start, p.spans[i].End
+		}
+	}
+	return infos
+}
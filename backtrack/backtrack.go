@@ -0,0 +1,515 @@
+// Package backtrack implements regular expressions with back-references,
+// which can not be matched by package regexp. Expressions use the syntax
+// of package regexp, extended with \1 to \9 referring to the text matched
+// by the capture groups and with \< and \> matching at the start and end
+// of a word, and are matched with a backtracking search.
+//
+// A backtracking search can take time exponential in the length of the
+// input. To guard against this, a search gives up once trying to match at
+// any one position of the input takes more than a fixed number of steps.
+// The methods whose names end in Err then return ErrStepLimit, while the
+// others report no match.
+package backtrack
+
+import (
+	"errors"
+	"fmt"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultMaxSteps is the number of steps a search may take at a single
+// position of the input before it is abandoned, unless set otherwise with
+// CompileLimit.
+const DefaultMaxSteps = 1000000
+
+// The operators added to those of package syntax. The group of a
+// back-reference is its Cap.
+const (
+	opBackref   syntax.Op = 200 + iota
+	opWordStart           // \<
+	opWordEnd             // \>
+)
+
+// Prefixes of the names of the empty capture groups standing for
+// back-references and for \< and \> while the expression is parsed.
+const (
+	backrefPrefix = "backref_"
+	wordPrefix    = "word_"
+)
+
+// isMarker reports whether the capture group name stands for one of the
+// extensions to the syntax.
+func isMarker(name string) bool {
+	return strings.HasPrefix(name, backrefPrefix) || strings.HasPrefix(name, wordPrefix)
+}
+
+var (
+	ErrBackref   = errors.New("invalid back reference")
+	ErrStepLimit = errors.New("regexp search gave up after too many steps")
+)
+
+// Regexp is a compiled regular expression. It is safe for concurrent use.
+type Regexp struct {
+	expr     string
+	re       *syntax.Regexp
+	numCap   int
+	maxSteps int
+	longest  bool
+}
+
+// Compile parses a regular expression, which may contain back-references.
+func Compile(expr string) (*Regexp, error) {
+	return CompileLimit(expr, DefaultMaxSteps)
+}
+
+// CompileLimit is like Compile, but a search gives up after maxSteps steps
+// at a single position.
+func CompileLimit(expr string, maxSteps int) (*Regexp, error) {
+	marked, err := markExtensions(expr)
+	if err != nil {
+		return nil, err
+	}
+	re, err := syntax.Parse(marked, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+
+	// The groups standing for back-references are left out when numbering
+	// the capture groups.
+	names := re.CapNames()
+	caps := make([]int, len(names))
+	numCap := 0
+	for i, name := range names[1:] {
+		if !isMarker(name) {
+			numCap++
+			caps[i+1] = numCap
+		}
+	}
+
+	re = re.Simplify()
+	renumber(re, caps, map[*syntax.Regexp]bool{})
+	return &Regexp{
+		expr:     expr,
+		re:       re,
+		numCap:   numCap,
+		maxSteps: maxSteps,
+	}, nil
+}
+
+// markExtensions replaces each back-reference in expr with an empty capture
+// group named after the group it refers to, and each \< and \> with an
+// empty group named after the assertion. Unlike a literal character, a
+// group is kept apart from its neighbours by the parser. A reference must
+// follow the start of the group it refers to.
+func markExtensions(expr string) (string, error) {
+	var b strings.Builder
+	markCt, groupCt := 0, 0
+	inClass := false
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == '\\' && i+1 < len(expr):
+			n := expr[i+1]
+			if !inClass && n >= '1' && n <= '9' {
+				if int(n-'0') > groupCt {
+					return "", ErrBackref
+				}
+				markCt++
+				fmt.Fprintf(&b, "(?P<%s%d_%c>)", backrefPrefix, markCt, n)
+			} else if !inClass && (n == '<' || n == '>') {
+				markCt++
+				side := "start"
+				if n == '>' {
+					side = "end"
+				}
+				fmt.Fprintf(&b, "(?P<%s%d_%s>)", wordPrefix, markCt, side)
+			} else {
+				b.WriteByte(c)
+				b.WriteByte(n)
+			}
+			i++
+			continue
+		case c == '[' && !inClass:
+			inClass = true
+			b.WriteByte(c)
+			// A ']' at the start of a class stands for itself.
+			if strings.HasPrefix(expr[i+1:], "^]") {
+				b.WriteString("^]")
+				i += 2
+			} else if strings.HasPrefix(expr[i+1:], "]") {
+				b.WriteByte(']')
+				i++
+			}
+			continue
+		case c == '[' && inClass && strings.HasPrefix(expr[i+1:], ":"):
+			if end := strings.Index(expr[i+2:], ":]"); end >= 0 {
+				b.WriteString(expr[i : i+end+4])
+				i += end + 3
+				continue
+			}
+		case c == ']' && inClass:
+			inClass = false
+		case c == '(' && !inClass:
+			if !strings.HasPrefix(expr[i+1:], "?") || strings.HasPrefix(expr[i+1:], "?P<") {
+				groupCt++
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// renumber turns the groups standing for back-references into opBackref,
+// those standing for \< and \> into opWordStart and opWordEnd, and gives
+// the other groups their numbers from caps. Simplified expressions share
+// nodes, which are only renumbered once.
+func renumber(re *syntax.Regexp, caps []int, seen map[*syntax.Regexp]bool) {
+	if seen[re] {
+		return
+	}
+	seen[re] = true
+	if re.Op == syntax.OpCapture {
+		if strings.HasPrefix(re.Name, backrefPrefix) {
+			n := int(re.Name[len(re.Name)-1] - '0')
+			re.Op, re.Cap, re.Name, re.Sub = opBackref, n, "", nil
+			return
+		}
+		if strings.HasPrefix(re.Name, wordPrefix) {
+			re.Op = opWordStart
+			if strings.HasSuffix(re.Name, "_end") {
+				re.Op = opWordEnd
+			}
+			re.Cap, re.Name, re.Sub = 0, "", nil
+			return
+		}
+		re.Cap = caps[re.Cap]
+	}
+	for _, sub := range re.Sub {
+		renumber(sub, caps, seen)
+	}
+}
+
+// String returns the source text used to compile the regular expression.
+func (re *Regexp) String() string {
+	return re.expr
+}
+
+// Longest makes future searches prefer leftmost-longest matches, as
+// required by POSIX, rather than the first match found by backtracking
+// from the leftmost position. It is not safe to call Longest while
+// searches are running.
+func (re *Regexp) Longest() {
+	re.longest = true
+}
+
+// NumSubexp returns the number of parenthesized subexpressions.
+func (re *Regexp) NumSubexp() int {
+	return re.numCap
+}
+
+// MatchString reports whether s contains any match of re.
+func (re *Regexp) MatchString(s string) bool {
+	ok, _ := re.MatchStringErr(s)
+	return ok
+}
+
+// MatchStringErr is like MatchString, but returns ErrStepLimit if the
+// search gave up.
+func (re *Regexp) MatchStringErr(s string) (bool, error) {
+	m, err := re.search(s, 0)
+	return m != nil, err
+}
+
+// FindStringSubmatchIndex returns the leftmost match of re in s as pairs
+// of indices identifying the match and each submatch, as in package
+// regexp. Submatches that did not take part in the match are -1. A nil
+// result indicates no match.
+func (re *Regexp) FindStringSubmatchIndex(s string) []int {
+	m, _ := re.search(s, 0)
+	return m
+}
+
+// FindAllStringSubmatchIndex returns up to n successive non-overlapping
+// matches of re in s, or all of them if n is negative. As in package
+// regexp, empty matches abutting a preceding match are ignored.
+func (re *Regexp) FindAllStringSubmatchIndex(s string, n int) [][]int {
+	matches, _ := re.FindAllStringSubmatchIndexErr(s, n)
+	return matches
+}
+
+// FindAllStringSubmatchIndexErr is like FindAllStringSubmatchIndex, but
+// returns ErrStepLimit, along with the matches found before, if a search
+// gave up.
+func (re *Regexp) FindAllStringSubmatchIndexErr(s string, n int) ([][]int, error) {
+	var matches [][]int
+	pos, prevEnd := 0, -1
+	for pos <= len(s) && (n < 0 || len(matches) < n) {
+		m, err := re.search(s, pos)
+		if err != nil {
+			return matches, err
+		}
+		if m == nil {
+			break
+		}
+		accept := true
+		if m[1] == m[0] {
+			if m[0] == prevEnd {
+				accept = false
+			}
+			if m[0] >= len(s) {
+				pos = len(s) + 1
+			} else {
+				_, w := utf8.DecodeRuneInString(s[m[0]:])
+				pos = m[0] + w
+			}
+		} else {
+			pos = m[1]
+		}
+		if accept {
+			matches = append(matches, m)
+			prevEnd = m[1]
+		}
+	}
+	return matches, nil
+}
+
+// search returns the leftmost match of re in s starting at or after pos.
+// Of the matches starting there, the first one found is returned, or the
+// longest one if re is set to prefer those. Each position the match may
+// start at has its own budget of steps, so that long inputs can be
+// searched. If the search at one of them takes more than the maximum
+// number of steps it gives up with ErrStepLimit.
+func (re *Regexp) search(s string, pos int) ([]int, error) {
+	m := &matcher{
+		input:    s,
+		caps:     make([]int, 2*(re.numCap+1)),
+		maxSteps: re.maxSteps,
+	}
+	for start := pos; start <= len(s); {
+		for i := range m.caps {
+			m.caps[i] = -1
+		}
+		m.steps = 0
+		var longest []int
+		if m.match(re.re, start, func(end int) bool {
+			m.caps[0], m.caps[1] = start, end
+			if !re.longest {
+				return true
+			}
+			if longest == nil || end > longest[1] {
+				longest = append(longest[:0], m.caps...)
+			}
+			// Keep looking for a longer match, unless there can be none.
+			return end == len(s)
+		}) {
+			return m.caps, nil
+		}
+		if m.steps > m.maxSteps {
+			return nil, ErrStepLimit
+		}
+		if longest != nil {
+			return longest, nil
+		}
+		if start == len(s) {
+			break
+		}
+		_, w := utf8.DecodeRuneInString(s[start:])
+		start += w
+	}
+	return nil, nil
+}
+
+// matcher holds the state of a single search.
+type matcher struct {
+	input    string
+	caps     []int
+	steps    int
+	maxSteps int
+}
+
+// match reports whether re matches the input at i followed by anything
+// accepted by the continuation k, which is passed the end of the match.
+func (m *matcher) match(re *syntax.Regexp, i int, k func(int) bool) bool {
+	m.steps++
+	if m.steps > m.maxSteps {
+		return false
+	}
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return false
+	case syntax.OpEmptyMatch:
+		return k(i)
+	case syntax.OpLiteral:
+		fold := re.Flags&syntax.FoldCase != 0
+		for _, r := range re.Rune {
+			c, w := m.next(i)
+			if w == 0 || !(c == r || fold && equalFold(c, r)) {
+				return false
+			}
+			i += w
+		}
+		return k(i)
+	case opBackref:
+		j, ok := m.backref(re.Cap, i, re.Flags&syntax.FoldCase != 0)
+		return ok && k(j)
+	case syntax.OpCharClass:
+		c, w := m.next(i)
+		if w == 0 || !inClass(re.Rune, c) {
+			return false
+		}
+		return k(i + w)
+	case syntax.OpAnyCharNotNL:
+		c, w := m.next(i)
+		if w == 0 || c == '\n' {
+			return false
+		}
+		return k(i + w)
+	case syntax.OpAnyChar:
+		_, w := m.next(i)
+		if w == 0 {
+			return false
+		}
+		return k(i + w)
+	case syntax.OpBeginLine:
+		return (i == 0 || m.input[i-1] == '\n') && k(i)
+	case syntax.OpEndLine:
+		return (i == len(m.input) || m.input[i] == '\n') && k(i)
+	case syntax.OpBeginText:
+		return i == 0 && k(i)
+	case syntax.OpEndText:
+		return i == len(m.input) && k(i)
+	case syntax.OpWordBoundary:
+		return m.atWordBoundary(i) && k(i)
+	case syntax.OpNoWordBoundary:
+		return !m.atWordBoundary(i) && k(i)
+	case opWordStart:
+		return m.atWordBoundary(i) && i < len(m.input) && isWordChar(m.input[i]) && k(i)
+	case opWordEnd:
+		return m.atWordBoundary(i) && i > 0 && isWordChar(m.input[i-1]) && k(i)
+	case syntax.OpCapture:
+		n := re.Cap
+		return m.match(re.Sub[0], i, func(j int) bool {
+			start, end := m.caps[2*n], m.caps[2*n+1]
+			m.caps[2*n], m.caps[2*n+1] = i, j
+			if k(j) {
+				return true
+			}
+			m.caps[2*n], m.caps[2*n+1] = start, end
+			return false
+		})
+	case syntax.OpStar:
+		return m.repeat(re, 0, -1, 0, i, k)
+	case syntax.OpPlus:
+		return m.repeat(re, 1, -1, 0, i, k)
+	case syntax.OpQuest:
+		return m.repeat(re, 0, 1, 0, i, k)
+	case syntax.OpRepeat:
+		return m.repeat(re, re.Min, re.Max, 0, i, k)
+	case syntax.OpConcat:
+		return m.concat(re.Sub, i, k)
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if m.match(sub, i, k) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// repeat matches re.Sub[0] between min and max times, max being -1 for no
+// limit, having matched it n times so far.
+func (m *matcher) repeat(re *syntax.Regexp, min, max, n, i int, k func(int) bool) bool {
+	more := func() bool {
+		if max != -1 && n >= max {
+			return false
+		}
+		return m.match(re.Sub[0], i, func(j int) bool {
+			// Once the minimum has been reached, only the first
+			// repetition may match the empty string, repeating it
+			// further could only loop forever.
+			if j == i && n >= min && n > 0 {
+				return false
+			}
+			return m.repeat(re, min, max, n+1, j, k)
+		})
+	}
+	if n < min {
+		return more()
+	}
+	if re.Flags&syntax.NonGreedy != 0 {
+		return k(i) || more()
+	}
+	return more() || k(i)
+}
+
+func (m *matcher) concat(subs []*syntax.Regexp, i int, k func(int) bool) bool {
+	if len(subs) == 0 {
+		return k(i)
+	}
+	return m.match(subs[0], i, func(j int) bool {
+		return m.concat(subs[1:], j, k)
+	})
+}
+
+// backref matches the text of group n at i, returning the end of the
+// match. A group that did not take part in the match matches nothing.
+func (m *matcher) backref(n, i int, fold bool) (int, bool) {
+	start, end := m.caps[2*n], m.caps[2*n+1]
+	if start < 0 {
+		return 0, false
+	}
+	ref := m.input[start:end]
+	j := i + len(ref)
+	if j > len(m.input) {
+		return 0, false
+	}
+	if fold {
+		return j, strings.EqualFold(m.input[i:j], ref)
+	}
+	return j, m.input[i:j] == ref
+}
+
+// next returns the character at i and its width, which is 0 at the end of
+// the input.
+func (m *matcher) next(i int) (rune, int) {
+	if i >= len(m.input) {
+		return 0, 0
+	}
+	return utf8.DecodeRuneInString(m.input[i:])
+}
+
+func (m *matcher) atWordBoundary(i int) bool {
+	before := i > 0 && isWordChar(m.input[i-1])
+	after := i < len(m.input) && isWordChar(m.input[i])
+	return before != after
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// inClass reports whether c is in the class given as pairs of inclusive
+// ranges.
+func inClass(ranges []rune, c rune) bool {
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if ranges[i] <= c && c <= ranges[i+1] {
+			return true
+		}
+	}
+	return false
+}
+
+// equalFold reports whether a and b are equal under simple case folding.
+func equalFold(a, b rune) bool {
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package backtrack
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFindStringSubmatchIndex(t *testing.T) {
+	tests := []struct {
+		expr  string
+		input string
+		match []int
+	}{
+		{`(a*)\1`, "baaaab", []int{0, 0, 0, 0}},
+		{`(a+)\1`, "baaaab", []int{1, 5, 1, 3}},
+		{`(.)\1`, "abccd", []int{2, 4, 2, 3}},
+		{`^(.*)\n\1$`, "abc\nabc", []int{0, 7, 0, 3}},
+		{`^(.*)\n\1$`, "abc\nabd", nil},
+		{`(a)|b\1`, "b", nil},
+		{`(x)(y)?\2`, "x", nil},
+		{`(?i)(a)\1`, "aA", []int{0, 2, 0, 1}},
+		{`(a)(b)\2\1`, "xabbay", []int{1, 5, 1, 2, 2, 3}},
+		{`(\w+) \1`, "the the end", []int{0, 7, 0, 3}},
+		{`([a-c]+)-\1`, "ab-ab", []int{0, 5, 0, 2}},
+		{`(a){2}\1`, "aaa", []int{0, 3, 1, 2}},
+		{`(?s)(.)\1`, "\n\n", []int{0, 2, 0, 1}},
+		{`(ab|a)\1c`, "aac", []int{0, 3, 0, 1}},
+		{`\<a`, "ba a", []int{3, 4}},
+		{`a\>`, "ab a", []int{3, 4}},
+		{`o\<`, "foo bar", nil},
+		{`\>b`, "foo bar", nil},
+		{`\<\>`, "a  b", nil},
+		{`[\<]`, "a<", []int{1, 2}},
+	}
+
+	for i, tt := range tests {
+		re, err := Compile(tt.expr)
+		if err != nil {
+			t.Errorf("Expr [%d] %s: unexpected error %v", i, tt.expr, err)
+			continue
+		}
+		got := re.FindStringSubmatchIndex(tt.input)
+		if !reflect.DeepEqual(got, tt.match) {
+			t.Errorf("Expr [%d] %s on %q: expected %v, got %v", i, tt.expr, tt.input, tt.match, got)
+		}
+	}
+}
+
+// TestSameAsRegexp checks that expressions without back-references match
+// the same way as with package regexp.
+func TestSameAsRegexp(t *testing.T) {
+	tests := []struct {
+		expr  string
+		input string
+	}{
+		{`a*`, "baaab"},
+		{`(a|ab)(c|bcd)(d*)`, "abcd"},
+		{`x*`, "axxbx"},
+		{`(a+)(b+)?`, "aab ab a"},
+		{`^$`, ""},
+		{`\bfoo\b`, "foo food foo"},
+		{`[^a]+`, "aabca\nda"},
+		{`a{2,3}`, "aaaaaaa"},
+		{`(a*)*`, "aab"},
+		{`(a*?)b`, "aab"},
+		{`é+`, "aéé"},
+	}
+
+	for i, tt := range tests {
+		want := regexp.MustCompile(tt.expr).FindAllStringSubmatchIndex(tt.input, -1)
+		re, err := Compile(tt.expr)
+		if err != nil {
+			t.Errorf("Expr [%d] %s: unexpected error %v", i, tt.expr, err)
+			continue
+		}
+		got := re.FindAllStringSubmatchIndex(tt.input, -1)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expr [%d] %s on %q: expected %v, got %v", i, tt.expr, tt.input, want, got)
+		}
+	}
+}
+
+func TestLongest(t *testing.T) {
+	tests := []struct {
+		expr  string
+		input string
+		match []int
+	}{
+		{`x|xy`, "xyz", []int{0, 2}},
+		{`a(b|bc)`, "abcd", []int{0, 3, 1, 3}},
+		{`(a|ab)(c|bcd)\2*`, "abcdbcd", []int{0, 7, 0, 1, 1, 4}},
+		{`(a*)\1`, "aaaaa", []int{0, 4, 0, 2}},
+		{`b*`, "abb", []int{0, 0}},
+	}
+
+	for i, tt := range tests {
+		re, err := Compile(tt.expr)
+		if err != nil {
+			t.Errorf("Expr [%d] %s: unexpected error %v", i, tt.expr, err)
+			continue
+		}
+		re.Longest()
+		got := re.FindStringSubmatchIndex(tt.input)
+		if !reflect.DeepEqual(got, tt.match) {
+			t.Errorf("Expr [%d] %s on %q: expected %v, got %v", i, tt.expr, tt.input, tt.match, got)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{`(a)\2`, `\1(a)`, `(a`, `a**`} {
+		if _, err := Compile(expr); err == nil {
+			t.Errorf("Expr %s: expected an error", expr)
+		}
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	re, err := CompileLimit(`(a*)*\1b`, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re.MatchString(strings.Repeat("a", 40)) {
+		t.Errorf("Expected the search to give up without a match")
+	}
+	if _, err := re.MatchStringErr(strings.Repeat("a", 40)); err != ErrStepLimit {
+		t.Errorf("Expected %v, got %v", ErrStepLimit, err)
+	}
+	matches, err := re.FindAllStringSubmatchIndexErr("ab "+strings.Repeat("a", 40), -1)
+	if err != ErrStepLimit || len(matches) != 1 {
+		t.Errorf("Expected one match followed by %v, got %v and %v", ErrStepLimit, matches, err)
+	}
+	if !re.MatchString("ab") {
+		t.Errorf("Expected a short input to match within the limit")
+	}
+}
+
+// TestLongInput checks that the steps taken at each position of a long
+// input do not add up to the limit.
+func TestLongInput(t *testing.T) {
+	re, err := Compile(`(a)\1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.Repeat("b", 400000) + "aa"
+	loc, err := re.FindAllStringSubmatchIndexErr(line, -1)
+	if err != nil {
+		t.Fatalf("Search of a long line failed: %v", err)
+	}
+	if len(loc) != 1 || loc[0][0] != 400000 {
+		t.Errorf("Expected a match at 400000, got %v", loc)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	gosed "github.com/zkry/go-sed"
+	"github.com/zkry/go-sed/ast"
+)
+
+// debugEscaper writes out the pattern and hold space on a single line, the
+// way GNU sed --debug does.
+var debugEscaper = strings.NewReplacer(
+	"\\", `\\`, "\n", `\n`, "\t", `\t`, "\r", `\r`,
+	"\f", `\f`, "\v", `\v`, "\a", `\a`, "\b", `\b`,
+)
+
+// debugTracer writes a trace of a run in the format of GNU sed --debug:
+// each command run is shown along with the pattern and hold space it
+// leaves whenever they change. Unlike GNU sed, commands whose address does
+// not match are shown as skipped, and jumps made by branches are shown.
+type debugTracer struct {
+	w             io.Writer
+	stmts         []ast.StmtInfo
+	pattern, hold string // The pattern and hold space as last shown.
+}
+
+// printProgram writes the program in canonical form, as it was understood.
+func printProgram(w io.Writer, program *gosed.Program) {
+	fmt.Fprintln(w, "SED PROGRAM:")
+	for _, line := range strings.SplitAfter(program.String(), "\n") {
+		switch line {
+		case "":
+		case "\n":
+			fmt.Fprint(w, line)
+		default:
+			fmt.Fprint(w, "  "+line)
+		}
+	}
+}
+
+func (t *debugTracer) StartCycle(lineNo int, pattern, hold string) {
+	fmt.Fprintf(t.w, "INPUT:   line %d\n", lineNo)
+	fmt.Fprintf(t.w, "PATTERN: %s\n", debugEscaper.Replace(pattern))
+	t.pattern, t.hold = pattern, hold
+}
+
+func (t *debugTracer) Address(stmt ast.StmtInfo, matched bool) {
+	label := "COMMAND:"
+	if !matched {
+		label = "SKIPPED:"
+	}
+	t.printStmt(label, stmt)
+}
+
+func (t *debugTracer) Exec(stmt ast.StmtInfo, pattern, hold string) {
+	t.printSpaces(pattern, hold)
+}
+
+func (t *debugTracer) Branch(stmt ast.StmtInfo, target int) {
+	if target >= len(t.stmts) {
+		fmt.Fprintln(t.w, "JUMP:    to end of script")
+		return
+	}
+	t.printStmt("JUMP:    to", t.stmts[target])
+}
+
+func (t *debugTracer) EndCycle(pattern, hold string) {
+	t.printSpaces(pattern, hold)
+	fmt.Fprintln(t.w, "END-OF-CYCLE:")
+}
+
+// printStmt writes stmt on a single line after label, indented by the
+// depth of its block. As with GNU sed, the text of a, i and c follows the
+// backslash after the command.
+func (t *debugTracer) printStmt(label string, stmt ast.StmtInfo) {
+	text := strings.Replace(stmt.Text, "\\\n", "\\", 1)
+	text = strings.Replace(text, "\\\n", `\n`, -1)
+	fmt.Fprintf(t.w, "%s %s%s\n", label, strings.Repeat("  ", stmt.Depth), text)
+}
+
+// printSpaces writes out the pattern and hold space if they changed since
+// they were last shown.
+func (t *debugTracer) printSpaces(pattern, hold string) {
+	if pattern != t.pattern {
+		fmt.Fprintf(t.w, "PATTERN: %s\n", debugEscaper.Replace(pattern))
+		t.pattern = pattern
+	}
+	if hold != t.hold {
+		fmt.Fprintf(t.w, "HOLD:    %s\n", debugEscaper.Replace(hold))
+		t.hold = hold
+	}
+}
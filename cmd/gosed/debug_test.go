@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	gosed "github.com/zkry/go-sed"
+)
+
+func TestDebugTracer(t *testing.T) {
+	var out bytes.Buffer
+	tracer := &debugTracer{w: &out}
+	program, errs := gosed.Compile("1{h;s/a/b\\n/};$!d;s/c/C/;tx;G;:x", gosed.Options{Tracer: tracer})
+	if len(errs) > 0 {
+		t.Fatalf("Program encountered errors %v", errs)
+	}
+	tracer.stmts = program.Statements()
+	printProgram(&out, program)
+	program.Exec(context.Background(), strings.NewReader("a\nc\n"), &out)
+
+	expected := `SED PROGRAM:
+  1 {
+    h
+    s/a/b\n/
+  }
+  $! d
+  s/c/C/
+  t x
+  G
+  :x
+INPUT:   line 1
+PATTERN: a
+COMMAND: 1 {
+COMMAND:   h
+HOLD:    a
+COMMAND:   s/a/b\n/
+PATTERN: b\n
+COMMAND: $! d
+END-OF-CYCLE:
+INPUT:   line 2
+PATTERN: c
+SKIPPED: 1 {
+SKIPPED: $! d
+COMMAND: s/c/C/
+PATTERN: C
+COMMAND: t x
+JUMP:    to end of script
+END-OF-CYCLE:
+C
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out.String())
+	}
+}
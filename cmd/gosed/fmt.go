@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	gosed "github.com/zkry/go-sed"
+)
+
+const fmtUsage = "usage: gosed fmt [-w] [-E] file.sed...\n"
+
+// runFmt formats the sed scripts named in args, the gosed fmt command,
+// and returns the exit status. The scripts are written to stdout, or with
+// -w back to their files.
+func runFmt(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("gosed fmt", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, fmtUsage) }
+	write := fs.Bool("w", false, "")
+	var opt gosed.Options
+	fs.BoolVar(&opt.ExtendRegexp, "E", false, "")
+	fs.BoolVar(&opt.ExtendRegexp, "r", false, "")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return exitBadUsage
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprint(os.Stderr, fmtUsage)
+		return exitBadUsage
+	}
+
+	status := 0
+	for _, name := range fs.Args() {
+		if s := formatFile(name, *write, opt, stdout); s > status {
+			status = s
+		}
+	}
+	return status
+}
+
+// formatFile formats the script in the file name, writing it back to the
+// file if write is set and to stdout otherwise. It returns the exit
+// status.
+func formatFile(name string, write bool, opt gosed.Options, stdout io.Writer) int {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosed: couldn't open file %s: %v\n", name, err)
+		return exitPanic
+	}
+	out, errs := gosed.Format(strings.TrimSuffix(string(data), "\n"), opt)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			err.File = name
+		}
+		printCompileErrors(errs)
+		return exitBadUsage
+	}
+	if !write {
+		fmt.Fprint(stdout, out)
+		return 0
+	}
+	if out == string(data) {
+		return 0
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosed: couldn't write %s: %v\n", name, pathError(err))
+		return exitPanic
+	}
+	err = replaceFile(name, fi, "", func(w io.Writer) error {
+		_, err := io.WriteString(w, out)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosed: %v\n", err)
+		return exitPanic
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFmt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "script.sed")
+	script := "# Join lines.\n:a;N;$!ba;# loop\ns|\\n| |g\n"
+	formatted := "# Join lines.\n:a\nN\n$! b a\n# loop\ns/\\n/ /g\n"
+	if err := ioutil.WriteFile(name, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if status := runFmt([]string{name}, &out); status != 0 {
+		t.Fatalf("Expected status 0, got %d", status)
+	}
+	if out.String() != formatted {
+		t.Errorf("Expected output %q, got %q", formatted, out.String())
+	}
+
+	out.Reset()
+	if status := runFmt([]string{"-w", name}, &out); status != 0 {
+		t.Fatalf("Expected status 0 with -w, got %d", status)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected no output with -w, got %q", out.String())
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != formatted {
+		t.Errorf("Expected file to contain %q, got %q", formatted, data)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected file mode to be kept as %v, got %v", os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	bad := filepath.Join(dir, "bad.sed")
+	if err := ioutil.WriteFile(bad, []byte("p;k\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status := runFmt([]string{bad}, &out); status != exitBadUsage {
+		t.Errorf("Expected status %d for a script that does not compile, got %d", exitBadUsage, status)
+	}
+	if status := runFmt([]string{filepath.Join(dir, "missing.sed")}, &out); status != exitPanic {
+		t.Errorf("Expected status %d for a missing script, got %d", exitPanic, status)
+	}
+}
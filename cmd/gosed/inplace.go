@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gosed "github.com/zkry/go-sed"
+	"github.com/zkry/go-sed/ast"
+)
+
+// inPlaceFlag is the value of the -i and --in-place flags. The flag may be
+// given alone or with a suffix used to name backups, as in -i=.bak.
+type inPlaceFlag struct {
+	c *Config
+}
+
+func (f inPlaceFlag) String() string {
+	if f.c == nil {
+		return ""
+	}
+	return f.c.inplaceExtension
+}
+
+func (f inPlaceFlag) Set(v string) error {
+	f.c.editInplace = true
+	if v != "true" {
+		f.c.inplaceExtension = v
+	}
+	return nil
+}
+
+func (f inPlaceFlag) IsBoolFlag() bool {
+	return true
+}
+
+// inPlaceArgs rewrites the GNU style -iSUFFIX argument, which the flag
+// package can not parse, to the equivalent -i=SUFFIX. Only an argument
+// that does not name a flag of fs is rewritten, and only among the flags,
+// which end at the first argument that is not one.
+func inPlaceArgs(fs *flag.FlagSet, args []string) []string {
+	res := make([]string, len(args))
+	copy(res, args)
+	for i := 0; i < len(res); i++ {
+		arg := res[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		name := strings.TrimPrefix(arg[1:], "-")
+		value := strings.Contains(name, "=")
+		if value {
+			name = name[:strings.Index(name, "=")]
+		}
+		f := fs.Lookup(name)
+		switch {
+		case f == nil && strings.HasPrefix(arg, "-i") && !strings.HasPrefix(arg, "--"):
+			res[i] = "-i=" + arg[2:]
+		case f != nil && !value && !isBoolFlag(f):
+			// The value of the flag is the next argument.
+			i++
+		}
+	}
+	return res
+}
+
+// isBoolFlag reports whether f is given without a value, like -n.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// backupName returns the name of the backup of the file name. Each '*' in
+// suffix is replaced by the base name of the file, otherwise suffix is
+// appended to it. The backup is placed relative to the file's directory.
+func backupName(name, suffix string) string {
+	dir, base := filepath.Split(name)
+	if strings.Contains(suffix, "*") {
+		return dir + strings.Replace(suffix, "*", base, -1)
+	}
+	return name + suffix
+}
+
+// readError is the error for a file to edit that could not be read, after
+// which the other files are still edited.
+type readError struct {
+	error
+}
+
+// editInPlace runs program over the file name and replaces the file's
+// content with the output, using replaceFile. If suffix is not empty, the
+// original file is kept as a backup. The files written to by the program
+// are taken from files, so that they hold the output of every file edited.
+func editInPlace(program *gosed.Program, name, suffix string, files *ast.Files) (ast.Result, error) {
+	var res ast.Result
+	fi, err := os.Stat(name)
+	if err != nil {
+		return res, readError{fmt.Errorf("can't read %s: %v", name, pathError(err))}
+	}
+	if !fi.Mode().IsRegular() {
+		return res, fmt.Errorf("couldn't edit %s: not a regular file", name)
+	}
+
+	in, err := os.Open(name)
+	if err != nil {
+		return res, readError{fmt.Errorf("can't read %s: %v", name, pathError(err))}
+	}
+	defer in.Close()
+
+	backup := ""
+	if suffix != "" {
+		backup = backupName(name, suffix)
+	}
+	err = replaceFile(name, fi, backup, func(w io.Writer) error {
+		res = program.ExecWith(context.Background(), in, w, gosed.RunOptions{InputName: name, Files: files})
+		if res.Err != nil {
+			return fmt.Errorf("couldn't edit %s: %v", name, res.Err)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// replaceFile replaces the content of the file name, described by fi, with
+// what write writes. The content is written to a temporary file in the
+// same directory, which is then renamed over the original so that the file
+// is never left partially written. The file's mode and owner are kept. If
+// backup is not empty, the original file is renamed to it first.
+func replaceFile(name string, fi os.FileInfo, backup string, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "gosed")
+	if err != nil {
+		return fmt.Errorf("couldn't open temporary file: %v", err)
+	}
+	defer func() {
+		// Only still present if writing failed.
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("couldn't write %s: %v", tmp.Name(), err)
+	}
+	// The owner is set first as changing it may clear the setuid bits.
+	copyOwner(tmp, fi)
+	if err := tmp.Chmod(fi.Mode()); err != nil {
+		return fmt.Errorf("couldn't set mode of %s: %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("couldn't write %s: %v", tmp.Name(), err)
+	}
+
+	if backup != "" {
+		if err := os.Rename(name, backup); err != nil {
+			return fmt.Errorf("couldn't rename %s: %v", name, err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return fmt.Errorf("couldn't rename %s: %v", tmp.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	gosed "github.com/zkry/go-sed"
+)
+
+func TestInPlaceArgs(t *testing.T) {
+	var config Config
+	fs := flag.NewFlagSet("gosed", flag.ContinueOnError)
+	fs.Var(&config.eCommands, "e", "")
+	fs.BoolVar(&config.silenceLine, "n", false, "")
+	fs.BoolVar(&config.interactive, "interactive", false, "")
+	fs.Var(inPlaceFlag{&config}, "i", "")
+	fs.Var(inPlaceFlag{&config}, "in-place", "")
+
+	cases := []struct {
+		args []string
+		exp  []string
+	}{
+		{[]string{"-i", "p", "f"}, []string{"-i", "p", "f"}},
+		{[]string{"-i.bak", "p", "f"}, []string{"-i=.bak", "p", "f"}},
+		{[]string{"-i=.bak", "p", "f"}, []string{"-i=.bak", "p", "f"}},
+		{[]string{"-n", "--", "-ix"}, []string{"-n", "--", "-ix"}},
+		{[]string{"-in-place=.bak", "p", "f"}, []string{"-in-place=.bak", "p", "f"}},
+		{[]string{"--in-place", "p", "f"}, []string{"--in-place", "p", "f"}},
+		{[]string{"-interactive", "f"}, []string{"-interactive", "f"}},
+		{[]string{"-e", "-i.x", "-i.bak", "f"}, []string{"-e", "-i.x", "-i=.bak", "f"}},
+		{[]string{"-n", "p", "-i.bak"}, []string{"-n", "p", "-i.bak"}},
+	}
+	for i, c := range cases {
+		got := inPlaceArgs(fs, c.args)
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("Test %d: expected %v, got %v", i, c.exp, got)
+		}
+	}
+}
+
+func TestBackupName(t *testing.T) {
+	cases := []struct {
+		name, suffix, exp string
+	}{
+		{"file.txt", ".bak", "file.txt.bak"},
+		{"dir/file.txt", ".bak", "dir/file.txt.bak"},
+		{"dir/file.txt", "bak/*.orig", "dir/bak/file.txt.orig"},
+		{"file.txt", "old_*_*", "old_file.txt_file.txt"},
+	}
+	for i, c := range cases {
+		if got := backupName(c.name, c.suffix); got != c.exp {
+			t.Errorf("Test %d: expected %s, got %s", i, c.exp, got)
+		}
+	}
+}
+
+func TestEditInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file.txt")
+	if err := ioutil.WriteFile(name, []byte("one\ntwo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "bak"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	program := gosed.MustCompile("$s/two/2/;1d", gosed.Options{})
+	if _, err := editInPlace(program, name, "bak/*.orig", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "2\n" {
+		t.Errorf("Expected edited file to contain %q, got %q", "2\n", data)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected file mode to be kept as %v, got %v", os.FileMode(0600), fi.Mode().Perm())
+	}
+	backup, err := ioutil.ReadFile(filepath.Join(dir, "bak", "file.txt.orig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != "one\ntwo\n" {
+		t.Errorf("Expected backup to contain %q, got %q", "one\ntwo\n", backup)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected no temporary files to be left behind, found %d files", len(files))
+	}
+
+	if _, err := editInPlace(program, dir, "", nil); err == nil {
+		t.Errorf("Expected an error editing a directory")
+	}
+	if _, err := editInPlace(program, filepath.Join(dir, "missing"), "", nil); err == nil {
+		t.Errorf("Expected an error editing a missing file")
+	} else if _, ok := err.(readError); !ok {
+		t.Errorf("Expected a read error editing a missing file, got %v", err)
+	}
+}
+
+func TestEditFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{filepath.Join(dir, "f1"), filepath.Join(dir, "f2")}
+	for i, name := range names {
+		if err := ioutil.WriteFile(name, []byte{'a' + byte(i), '\n'}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(dir, "out")
+	program := gosed.MustCompile("w "+out, gosed.Options{})
+	if status := editFiles(program, names, ""); status != 0 {
+		t.Fatalf("Expected status 0, got %d", status)
+	}
+
+	// The file written to holds the lines of every file edited.
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a\nb\n" {
+		t.Errorf("Expected %s to contain %q, got %q", out, "a\nb\n", data)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// inputFiles reads the named files one after the other as a single
+// stream, the way sed reads its input. A file whose last line has no
+// newline is given one if more input follows. Files that can not be opened
+// are reported to errs and skipped, and the name - stands for stdin.
+// inputFiles is an ast.NamedInput, so that the F command prints the name
+// of the file each line comes from.
+type inputFiles struct {
+	names   []string
+	errs    io.Writer
+	name    string // The name of the file being read.
+	f       *os.File
+	r       *bufio.Reader
+	endNL   bool        // Whether the input read so far is empty or ends with a newline.
+	fresh   bool        // Whether nothing has been read from the current file yet.
+	missing bool        // Whether any of the files could not be opened.
+	skipped bool        // Whether input was read after a file that could not be opened.
+	read    int64       // The number of bytes read so far.
+	parts   []inputPart // The files read from, in order.
+}
+
+// inputPart is a file which was read from, starting at offset start of
+// the input.
+type inputPart struct {
+	start int64
+	name  string
+}
+
+func newInputFiles(names []string, errs io.Writer) *inputFiles {
+	return &inputFiles{names: names, errs: errs, endNL: true}
+}
+
+func (in *inputFiles) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if in.r == nil && !in.open() {
+			return 0, io.EOF
+		}
+		// The newline missing from the end of the previous file is only
+		// added once the next one turns out to have data.
+		if in.fresh && !in.endNL {
+			if _, err := in.r.Peek(1); err == nil {
+				in.endNL = true
+				in.read++
+				p[0] = '\n'
+				return 1, nil
+			}
+		}
+		n, err := in.r.Read(p)
+		if n > 0 {
+			if in.fresh {
+				in.parts = append(in.parts, inputPart{in.read, in.name})
+				in.fresh = false
+			}
+			in.skipped = in.skipped || in.missing
+			in.endNL = p[n-1] == '\n'
+			in.read += int64(n)
+			return n, nil
+		}
+		if err == io.EOF {
+			in.Close()
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("read error on %s: %v", in.name, err)
+		}
+	}
+}
+
+// NameAt returns the name of the file the byte at offset was read from.
+func (in *inputFiles) NameAt(offset int64) string {
+	for i := len(in.parts) - 1; i >= 0; i-- {
+		if in.parts[i].start <= offset {
+			return in.parts[i].name
+		}
+	}
+	return "-"
+}
+
+// open opens the next of the files that can be opened. It returns false
+// when there are no more files.
+func (in *inputFiles) open() bool {
+	for len(in.names) > 0 {
+		name := in.names[0]
+		in.names = in.names[1:]
+		if name == "-" {
+			in.name, in.r, in.fresh = "-", bufio.NewReader(os.Stdin), true
+			return true
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(in.errs, "gosed: can't read %s: %v\n", name, pathError(err))
+			in.missing = true
+			continue
+		}
+		in.name, in.f, in.r, in.fresh = name, f, bufio.NewReader(f), true
+		return true
+	}
+	return false
+}
+
+// pathError returns the cause of err if it is an *os.PathError, whose
+// message repeats the path the caller already names.
+func pathError(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+// Close closes the file being read, if any.
+func (in *inputFiles) Close() error {
+	var err error
+	if in.f != nil {
+		err = in.f.Close()
+	}
+	in.f, in.r = nil, nil
+	return err
+}
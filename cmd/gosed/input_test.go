@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gosed "github.com/zkry/go-sed"
+)
+
+func TestInputFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := map[string]string{
+		"lines": "1\n2\n",
+		"nonl":  "a",
+		"empty": "",
+		"nonl2": "b",
+		"long":  strings.Repeat("x", 10000) + "\n" + strings.Repeat("y", 5000),
+	}
+	for name, data := range contents {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		files   []string
+		exp     string
+		missing bool
+	}{
+		{[]string{"lines", "lines"}, "1\n2\n1\n2\n", false},
+		{[]string{"nonl", "lines"}, "a\n1\n2\n", false},
+		{[]string{"lines", "nonl"}, "1\n2\na", false},
+		{[]string{"nonl", "empty"}, "a", false},
+		{[]string{"nonl", "empty", "nonl2"}, "a\nb", false},
+		{[]string{"missing", "nonl", "missing"}, "a", true},
+		{[]string{"missing"}, "", true},
+		{[]string{"long", "lines"}, contents["long"] + "\n1\n2\n", false},
+	}
+	for i, c := range cases {
+		var names []string
+		for _, f := range c.files {
+			names = append(names, filepath.Join(dir, f))
+		}
+		var errs bytes.Buffer
+		in := newInputFiles(names, &errs)
+		// Read in small chunks so that lines are split across reads.
+		data, err := ioutil.ReadAll(bufio.NewReaderSize(onlyReader{in}, 16))
+		in.Close()
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if string(data) != c.exp {
+			t.Errorf("Test %d: expected %q, got %q", i, c.exp, data)
+		}
+		if in.missing != c.missing {
+			t.Errorf("Test %d: expected missing to be %v, got %v", i, c.missing, in.missing)
+		}
+		if c.missing && !strings.Contains(errs.String(), "can't read") {
+			t.Errorf("Test %d: expected the missing file to be reported, got %q", i, errs.String())
+		}
+		if n := strings.Count(errs.String(), dir); c.missing && n != strings.Count(errs.String(), "\n") {
+			t.Errorf("Test %d: expected the path once per missing file, got %q", i, errs.String())
+		}
+	}
+
+	in := newInputFiles([]string{dir}, ioutil.Discard)
+	defer in.Close()
+	if _, err := ioutil.ReadAll(in); err == nil {
+		t.Errorf("Expected an error reading a directory")
+	}
+}
+
+func TestInputName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f1, f2 := filepath.Join(dir, "f1"), filepath.Join(dir, "f2")
+	if err := ioutil.WriteFile(f1, []byte("a\nb"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f2, []byte("c\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	program := gosed.MustCompile("F", gosed.Options{SupressOutput: true})
+	if status := runFiles(program, []string{f1, f2}, w); status != 0 {
+		t.Fatalf("Expected status 0, got %d", status)
+	}
+	exp := f1 + "\n" + f1 + "\n" + f2 + "\n"
+	if out.String() != exp {
+		t.Errorf("Expected %q, got %q", exp, out.String())
+	}
+
+	if _, err := editInPlace(program, f1, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(f1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := f1 + "\n" + f1 + "\n"; string(data) != exp {
+		t.Errorf("Expected the edited file to contain %q, got %q", exp, data)
+	}
+}
+
+func TestRunFilesQuit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, missing := filepath.Join(dir, "f"), filepath.Join(dir, "missing")
+	if err := ioutil.WriteFile(f, []byte("a\nb\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		script string
+		files  []string
+		status int
+	}{
+		{"q5", []string{f, missing}, 5},
+		{"q5", []string{missing, f}, exitBadInput},
+		{"$q5", []string{f, missing}, 5},
+		{"p", []string{f, missing}, exitBadInput},
+		{"q", []string{missing, f}, exitBadInput},
+	}
+	for i, c := range cases {
+		program := gosed.MustCompile(c.script, gosed.Options{})
+		w := bufio.NewWriter(ioutil.Discard)
+		if status := runFiles(program, c.files, w); status != c.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, c.status, status)
+		}
+	}
+}
+
+// onlyReader hides any method of the reader other than Read, so that it is
+// read through Read alone.
+type onlyReader struct {
+	io.Reader
+}
@@ -2,19 +2,27 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"errors"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	gosed "github.com/zkry/go-sed"
+	"github.com/zkry/go-sed/ast"
 )
 
 var order int
 
+// The exit statuses of gosed, which are the same as those of GNU sed. A
+// program that quits with q or Q sets its own.
+const (
+	exitBadUsage = 1 // The script or the command line is invalid.
+	exitBadInput = 2 // One of the input files could not be opened.
+	exitPanic    = 4 // An I/O error stopped processing.
+)
+
 type Command struct {
 	order int
 	cmd   string
@@ -63,128 +71,220 @@ type Config struct {
 	eCommands        ECommands    // Translates to -e flag
 	editInplace      bool         // Translates to -i flag
 	inplaceExtension string       // Prameter for -i flag
-	extendedRegexp   bool         // Translates to -E flag
+	extendedRegexp   bool         // Translates to -E, -r and --regexp-extended flags
 	appendFile       bool         // Translates to -a flag
-	bufferedOutput   bool         // Translates to -l flag
+	lineLength       int          // Translates to -l and --line-length flags
+	posix            bool         // Translates to --posix flag, or POSIXLY_CORRECT being set
+	interactive      bool         // Translates to --interactive flag
+	debug            bool         // Translates to --debug flag
 	silenceLine      bool         // Translates to -n flag
 	commandCt        int
-	interactive      bool
 }
 
-func combineInputs(files []string) []byte {
-	var buff bytes.Buffer
-	for i, f := range files {
-		d, err := ioutil.ReadFile(f)
-		if err != nil {
-			fmt.Printf("gosed: %s: %v\n", f, err)
-		}
-		if i > 0 {
-			buff.WriteRune('\n')
-		}
-		buff.Write(d)
+// options returns the library options that correspond to the flags
+// passed in on the command line.
+func (c Config) options() gosed.Options {
+	opt := gosed.Options{
+		SupressOutput: c.silenceLine,
+		AppendFile:    c.appendFile,
+		ExtendRegexp:  c.extendedRegexp,
+		AllowExec:     true,
+		LineLength:    c.lineLength,
+		Posix:         c.posix,
 	}
-	return buff.Bytes()
+	if c.lineLength == 0 {
+		// -l 0 means never to wrap.
+		opt.LineLength = -1
+	}
+	return opt
 }
 
-func programFromConfig(conf Config) (*gosed.Program, error) {
-	var programBuff bytes.Buffer
-	for {
-		if len(conf.fileCommands) == 0 && len(conf.eCommands) == 0 {
-			break
-		} else if len(conf.fileCommands) == 0 || conf.eCommands[0].order < conf.eCommands[0].order {
-			cmd := conf.eCommands[0].cmd
+// scriptsFromConfig returns the -e expressions and -f files in the order
+// they were given on the command line.
+func scriptsFromConfig(conf Config) ([]gosed.Script, error) {
+	var scripts []gosed.Script
+	var exprCt int
+	for len(conf.fileCommands) > 0 || len(conf.eCommands) > 0 {
+		if len(conf.fileCommands) == 0 ||
+			(len(conf.eCommands) > 0 && conf.eCommands[0].order < conf.fileCommands[0].order) {
+			exprCt++
+			scripts = append(scripts, gosed.Script{
+				Name: fmt.Sprintf("-e #%d", exprCt),
+				Text: conf.eCommands[0].cmd,
+			})
 			conf.eCommands = conf.eCommands[1:]
-			programBuff.WriteString("\n" + cmd)
 		} else {
 			fname := conf.fileCommands[0].cmd
 			conf.fileCommands = conf.fileCommands[1:]
 			fdata, err := ioutil.ReadFile(fname)
 			if err != nil {
-				return nil, errors.New("could not read file " + fname)
+				return nil, fmt.Errorf("couldn't open file %s: %v", fname, err)
 			}
-			programBuff.WriteRune('\n')
-			programBuff.Write(fdata)
+			scripts = append(scripts, gosed.Script{
+				Name: fname,
+				Text: strings.TrimSuffix(string(fdata), "\n"),
+			})
 		}
 	}
+	return scripts, nil
+}
 
-	program, err := gosed.Compile(programBuff.String(), gosed.Options{})
-	if err != nil {
-		return nil, errors.New("syntax error: " + err.Error())
+// printCompileErrors writes each error to stderr along with the part of
+// the script it refers to.
+func printCompileErrors(errs ast.ErrorList) {
+	for _, err := range errs {
+		fmt.Fprint(os.Stderr, "gosed: "+err.Render())
 	}
-	return program, nil
 }
 
 func displayHelp() {
 
 }
 
-func runFromStdin(program *gosed.Program) {
-	r := bufio.NewReader(os.Stdin)
-	for {
-		line, err := r.ReadString('\n')
-		if err == io.EOF {
+// runFiles runs program over the files as a single stream of input, or
+// over stdin if there are none, writing the output to w, and returns the
+// exit status.
+func runFiles(program *gosed.Program, files []string, w *bufio.Writer) int {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	in := newInputFiles(files, os.Stderr)
+	defer in.Close()
+	res := program.Exec(context.Background(), in, w)
+	if res.Err != nil {
+		fmt.Fprintf(os.Stderr, "gosed: %v\n", res.Err)
+		return exitPanic
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "gosed: couldn't flush stdout: %v\n", err)
+		return exitPanic
+	}
+	// A program that quits before reaching the input after a missing file
+	// exits with its own status.
+	if in.missing && (!res.Quit || in.skipped) {
+		return exitBadInput
+	}
+	return res.ExitCode
+}
+
+// editFiles edits each of the files in place and returns the exit status.
+// Editing stops at the first file in which the program quits.
+func editFiles(program *gosed.Program, files []string, suffix string) (status int) {
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "gosed: no input files")
+		return exitBadUsage
+	}
+	// The files written to are shared by all of the files edited.
+	written := ast.NewFiles()
+	defer func() {
+		if err := written.Close(); err != nil && status != exitPanic {
+			fmt.Fprintf(os.Stderr, "gosed: couldn't write: %v\n", err)
+			status = exitPanic
+		}
+	}()
+	for _, f := range files {
+		res, err := editInPlace(program, f, suffix, written)
+		if _, ok := err.(readError); ok {
+			fmt.Fprintf(os.Stderr, "gosed: %v\n", err)
+			status = exitBadInput
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gosed: %v\n", err)
+			return exitPanic
+		}
+		if res.Quit {
+			if status == 0 {
+				status = res.ExitCode
+			}
 			break
 		}
-		out := program.FilterString(line)
-		fmt.Print(out)
 	}
+	return status
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs gosed with the command line arguments and returns the exit
+// status.
+func run() int {
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		return runFmt(os.Args[2:], os.Stdout)
+	}
+
 	var config Config
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
 	// flag.Var(&config.commandFiles, "f", "")
 	flag.Var(&config.fileCommands, "f", "")
 	flag.Var(&config.eCommands, "e", "")
 	flag.BoolVar(&config.silenceLine, "n", false, "")
-	flag.BoolVar(&config.bufferedOutput, "l", false, "")
+	flag.IntVar(&config.lineLength, "l", gosed.DefaultLineLength, "")
+	flag.IntVar(&config.lineLength, "line-length", gosed.DefaultLineLength, "")
+	_, posixlyCorrect := os.LookupEnv("POSIXLY_CORRECT")
+	flag.BoolVar(&config.posix, "posix", posixlyCorrect, "")
 	flag.BoolVar(&config.appendFile, "a", false, "")
 	flag.BoolVar(&config.extendedRegexp, "E", false, "")
-	flag.BoolVar(&config.interactive, "i", false, "")
-	flag.Parse()
+	flag.BoolVar(&config.extendedRegexp, "r", false, "")
+	flag.BoolVar(&config.extendedRegexp, "regexp-extended", false, "")
+	flag.BoolVar(&config.interactive, "interactive", false, "")
+	flag.BoolVar(&config.debug, "debug", false, "")
+	flag.Var(inPlaceFlag{&config}, "i", "")
+	flag.Var(inPlaceFlag{&config}, "in-place", "")
+	if err := flag.CommandLine.Parse(inPlaceArgs(flag.CommandLine, os.Args[1:])); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return exitBadUsage
+	}
 	config.commandCt = order
 
 	if config.interactive {
-		runInteractive()
+		return runInteractive(config, flag.Args())
 	}
-
 	if config.commandCt == 0 && flag.NArg() == 0 {
 		displayHelp()
-		return
+		return exitBadUsage
 	}
 
+	var scripts []gosed.Script
+	var files []string
 	if config.commandCt > 0 {
-		program, err := programFromConfig(config)
+		var err error
+		scripts, err = scriptsFromConfig(config)
 		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		if flag.NArg() > 0 {
-			// Read files and send them through commands.
-			programInput := combineInputs(flag.Args())
-			out := program.Filter(programInput)
-			fmt.Print(string(out))
-		} else {
-			// Read Stdout through commands
-			runFromStdin(program)
+			fmt.Fprintf(os.Stderr, "gosed: %v\n", err)
+			return exitPanic
 		}
-		return
+		files = flag.Args()
+	} else {
+		// Use arg[0] as command and arg[1:] as input files. If only one arg,
+		// read from stdin
+		scripts = []gosed.Script{{Name: "-e #1", Text: flag.Arg(0)}}
+		files = flag.Args()[1:]
 	}
 
-	if flag.NArg() > 0 {
-		// Use arg[0] as command and arg[1:] as input files. If only one arg,
-		// read from stdout
-		fname := flag.Arg(0)
-		program, err := gosed.Compile(fname, gosed.Options{})
-		if err != nil {
-			fmt.Printf("gosed: syntax error in %s\n", fname)
-			return
-		}
-		if flag.NArg() == 1 {
-			runFromStdin(program)
-			return
-		}
-		programInput := combineInputs(flag.Args()[1:])
-		out := program.Filter(programInput)
-		fmt.Print(string(out))
+	stdout := bufio.NewWriter(os.Stdout)
+	defer stdout.Flush()
+	opt := config.options()
+	var tracer *debugTracer
+	if config.debug {
+		tracer = &debugTracer{w: stdout}
+		opt.Tracer = tracer
+	}
+	program, errs := gosed.CompileScripts(scripts, opt)
+	if len(errs) > 0 {
+		printCompileErrors(errs)
+		return exitBadUsage
+	}
+	if tracer != nil {
+		tracer.stmts = program.Statements()
+		printProgram(stdout, program)
+	}
+
+	if config.editInplace {
+		return editFiles(program, files, config.inplaceExtension)
 	}
+	return runFiles(program, files, stdout)
 }
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// copyOwner is a no-op on systems without Unix file ownership.
+func copyOwner(f *os.File, fi os.FileInfo) {}
@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// copyOwner gives f the owner and group of the file described by fi. As
+// with GNU sed, failing to do so is not an error.
+func copyOwner(f *os.File, fi os.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if f.Chown(int(st.Uid), int(st.Gid)) != nil {
+		// Without the privilege to give the file away, at least try to
+		// keep its group.
+		f.Chown(-1, int(st.Gid))
+	}
+}
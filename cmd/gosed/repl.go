@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	gosed "github.com/zkry/go-sed"
+	"github.com/zkry/go-sed/ast"
+	"github.com/zkry/go-sed/lexer"
+	"github.com/zkry/go-sed/token"
+)
+
+const replHelp = `Type a sed command to run it over the buffer, whose content becomes
+the output of the command. A command ending in a backslash, or with a {
+that is not closed yet, goes on over the lines that follow, so that a\
+and its text can be typed in. Lines starting with a dot are commands of
+the REPL itself:
+
+  .step [command]  start stepping through command a cycle at a time, or
+                   run the next cycle of the command being stepped through
+  .goto N          run the command being stepped through up to line N
+  .undo            undo the last command
+  .print           print the buffer
+  .save FILE       save the history of the commands run so far
+  .load FILE       run each of the commands of a history saved by .save
+  .help            show this help
+  .quit            leave the REPL
+
+A history is not a sed script, as each of its commands is run over the
+output of the one before: 1d twice deletes two lines, while the script
+1d;1d deletes one. It holds the commands one after the other, as they were
+typed in, following a first line starting with #. Lines starting with #
+between the commands are ignored. So that it is not taken for a script, a
+history can not be saved to a file whose name ends in .sed.
+`
+
+// edit is a command run over the buffer, along with the buffer as it was
+// before so that it can be undone.
+type edit struct {
+	cmd    string
+	before string
+}
+
+// repl is an interactive session in which sed commands are run over a
+// buffer one after the other. The commands are run by the same runtime as
+// the batch mode, a cycle at a time when stepping through them.
+type repl struct {
+	opt     gosed.Options
+	out     io.Writer
+	buffer  string
+	history []edit
+
+	// The command being stepped through, if any, and its output so far.
+	stepCmd string
+	stepper *ast.Stepper
+	stepOut bytes.Buffer
+
+	// The lines typed in so far of a command that is not complete yet.
+	pending []string
+}
+
+// runInteractive runs the REPL over the content of the files, reading
+// commands from stdin, and returns the exit status.
+func runInteractive(config Config, files []string) int {
+	var buff bytes.Buffer
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gosed: can't read %s: %v\n", f, pathError(err))
+			return exitBadInput
+		}
+		buff.Write(data)
+	}
+	r := &repl{opt: config.options(), out: os.Stdout, buffer: buff.String()}
+	r.run(os.Stdin)
+	return 0
+}
+
+// run reads and runs commands from in until it is exhausted or .quit is
+// given.
+func (r *repl) run(in io.Reader) {
+	sc := bufio.NewScanner(in)
+	for {
+		if len(r.pending) > 0 {
+			fmt.Fprint(r.out, "...> ")
+		} else {
+			fmt.Fprint(r.out, "gosed> ")
+		}
+		if !sc.Scan() {
+			// End the line of the prompt.
+			fmt.Fprintln(r.out)
+			return
+		}
+		if !r.exec(sc.Text()) {
+			return
+		}
+	}
+}
+
+// exec runs a single line typed in. It returns false if the REPL should
+// stop.
+func (r *repl) exec(line string) bool {
+	if len(r.pending) == 0 {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return true
+		}
+	}
+	if len(r.pending) > 0 || !strings.HasPrefix(line, ".") {
+		if cmd, ok := r.readCommand(line); ok {
+			r.stopStepping()
+			r.runCommand(cmd)
+		}
+		return true
+	}
+
+	name, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, arg = line[:i], strings.TrimSpace(line[i:])
+	}
+	switch name {
+	case ".step":
+		r.step(arg)
+	case ".goto":
+		r.gotoLine(arg)
+	case ".undo":
+		r.undo()
+	case ".print":
+		fmt.Fprint(r.out, r.buffer)
+	case ".save":
+		r.save(arg)
+	case ".load":
+		r.load(arg)
+	case ".help":
+		fmt.Fprint(r.out, replHelp)
+	case ".quit":
+		return false
+	default:
+		fmt.Fprintf(r.out, "unknown command %s, see .help\n", name)
+	}
+	return true
+}
+
+// readCommand adds line to the command being typed in. Once the command is
+// complete it is returned along with true.
+func (r *repl) readCommand(line string) (string, bool) {
+	r.pending = append(r.pending, line)
+	cmd := strings.Join(r.pending, "\n")
+	if continues(cmd) {
+		return "", false
+	}
+	r.pending = nil
+	return cmd, true
+}
+
+// continues reports whether the command cmd goes on over the next line,
+// as it ends in a backslash that is not escaped or has a block that is not
+// closed yet.
+func continues(cmd string) bool {
+	if n := len(cmd) - len(strings.TrimRight(cmd, `\`)); n%2 == 1 {
+		return true
+	}
+	depth := 0
+	l := lexer.New(cmd)
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.LBRACE:
+			depth++
+		case token.RBRACE:
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+// compile compiles cmd, reporting any errors.
+func (r *repl) compile(cmd string) (*gosed.Program, bool) {
+	prg, errs := gosed.Compile(cmd, r.opt)
+	for _, err := range errs {
+		fmt.Fprint(r.out, err.Render())
+	}
+	return prg, len(errs) == 0
+}
+
+// runCommand runs cmd over the whole buffer and replaces the buffer with
+// the output.
+func (r *repl) runCommand(cmd string) {
+	prg, ok := r.compile(cmd)
+	if !ok {
+		return
+	}
+	var out bytes.Buffer
+	s := prg.NewStepper(strings.NewReader(r.buffer))
+	for s.Step(&out) {
+	}
+	if res := s.Close(); res.Err != nil {
+		fmt.Fprintf(r.out, "error: %v\n", res.Err)
+		return
+	}
+	r.history = append(r.history, edit{cmd: cmd, before: r.buffer})
+	r.buffer = out.String()
+	fmt.Fprint(r.out, r.buffer)
+	r.showSpaces(s)
+}
+
+// step starts stepping through cmd if it is given, otherwise it runs the
+// next cycle of the command being stepped through.
+func (r *repl) step(cmd string) {
+	if cmd != "" {
+		r.stopStepping()
+		prg, ok := r.compile(cmd)
+		if !ok {
+			return
+		}
+		r.stepCmd = cmd
+		r.stepper = prg.NewStepper(strings.NewReader(r.buffer))
+	}
+	if r.stepper == nil {
+		fmt.Fprintln(r.out, "nothing to step through, use .step command")
+		return
+	}
+	r.nextCycle()
+}
+
+// gotoLine runs the command being stepped through until the cycle for
+// the line arg has run.
+func (r *repl) gotoLine(arg string) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		fmt.Fprintf(r.out, "invalid line number %q\n", arg)
+		return
+	}
+	if r.stepper == nil {
+		fmt.Fprintln(r.out, "nothing to step through, use .step command")
+		return
+	}
+	if r.stepper.LineNo() >= n {
+		fmt.Fprintf(r.out, "already past line %d\n", n)
+		return
+	}
+	for r.stepper != nil && r.stepper.LineNo() < n {
+		r.nextCycle()
+	}
+}
+
+// nextCycle runs the next cycle of the command being stepped through and
+// shows what it output. Once the command is done, its output becomes the
+// buffer.
+func (r *repl) nextCycle() {
+	s := r.stepper
+	start := r.stepOut.Len()
+	if !s.Step(&r.stepOut) {
+		r.finishStepping()
+		return
+	}
+	fmt.Fprintf(r.out, "line %d\n", s.LineNo())
+	fmt.Fprint(r.out, r.stepOut.String()[start:])
+	r.showSpaces(s)
+}
+
+// finishStepping makes the output of the command stepped through the
+// buffer.
+func (r *repl) finishStepping() {
+	res := r.stepper.Close()
+	if res.Err != nil {
+		fmt.Fprintf(r.out, "error: %v\n", res.Err)
+	} else {
+		r.history = append(r.history, edit{cmd: r.stepCmd, before: r.buffer})
+		r.buffer = r.stepOut.String()
+		fmt.Fprintln(r.out, "done")
+	}
+	r.stepper, r.stepCmd = nil, ""
+	r.stepOut.Reset()
+}
+
+// stopStepping abandons the command being stepped through, leaving the
+// buffer as it was.
+func (r *repl) stopStepping() {
+	if r.stepper == nil {
+		return
+	}
+	r.stepper.Close()
+	r.stepper, r.stepCmd = nil, ""
+	r.stepOut.Reset()
+}
+
+// undo restores the buffer to what it was before the last command.
+func (r *repl) undo() {
+	if r.stepper != nil {
+		r.stopStepping()
+		fmt.Fprintln(r.out, "stopped stepping")
+		return
+	}
+	if len(r.history) == 0 {
+		fmt.Fprintln(r.out, "nothing to undo")
+		return
+	}
+	last := r.history[len(r.history)-1]
+	r.history = r.history[:len(r.history)-1]
+	r.buffer = last.before
+	fmt.Fprintf(r.out, "undid %s\n", last.cmd)
+}
+
+// historyHeader starts a history saved by .save. Each command of a history
+// is run over the output of the one before, so that the history is not a
+// sed script: 1d twice deletes two lines while the script 1d;1d deletes
+// one.
+const historyHeader = "# gosed history: each command is run on its own by .load.\n"
+
+// save writes the history of the commands run so far to the file name,
+// one after the other, to be run again by load. A command spanning lines
+// is read back whole as it was typed in.
+func (r *repl) save(name string) {
+	if name == "" {
+		fmt.Fprintln(r.out, "missing file name")
+		return
+	}
+	if strings.HasSuffix(name, ".sed") {
+		fmt.Fprintln(r.out, "a history is not a sed script, save it to a name not ending in .sed, see .help")
+		return
+	}
+	var history bytes.Buffer
+	history.WriteString(historyHeader)
+	for _, e := range r.history {
+		history.WriteString(e.cmd + "\n")
+	}
+	if err := ioutil.WriteFile(name, history.Bytes(), 0644); err != nil {
+		fmt.Fprintf(r.out, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(r.out, "saved %d commands to %s\n", len(r.history), name)
+}
+
+// load runs each of the commands of the history in the file name, saved
+// by save, over the buffer in turn.
+func (r *repl) load(name string) {
+	if name == "" {
+		fmt.Fprintln(r.out, "missing file name")
+		return
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		fmt.Fprintf(r.out, "error: %v\n", err)
+		return
+	}
+	r.stopStepping()
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(r.pending) == 0 && (line == "" || strings.HasPrefix(line, "#")) {
+			continue
+		}
+		if cmd, ok := r.readCommand(line); ok {
+			r.runCommand(cmd)
+		}
+	}
+	if len(r.pending) > 0 {
+		fmt.Fprintf(r.out, "error: %s ends in the middle of a command\n", name)
+		r.pending = nil
+	}
+}
+
+// showSpaces shows the pattern and hold space as s left them.
+func (r *repl) showSpaces(s *ast.Stepper) {
+	fmt.Fprintf(r.out, "pattern: %q\n", s.PatternSpace())
+	fmt.Fprintf(r.out, "hold:    %q\n", s.HoldSpace())
+}
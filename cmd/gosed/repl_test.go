@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestREPL(t *testing.T) {
+	var out bytes.Buffer
+	r := &repl{out: &out, buffer: "1\n2\n3\n"}
+	cases := []struct {
+		line   string
+		buffer string
+		output string // Part of what is expected to be output.
+	}{
+		{"s/2/two/", "1\ntwo\n3\n", "pattern: \"3\"\nhold:    \"\"\n"},
+		{"$!d", "3\n", "3\n"},
+		{".undo", "1\ntwo\n3\n", "undid $!d"},
+		{".step 1!G;h;$!d", "1\ntwo\n3\n", "line 1\npattern: \"1\"\nhold:    \"1\"\n"},
+		{".step", "1\ntwo\n3\n", "line 2\npattern: \"two\\n1\"\n"},
+		{".goto 3", "1\ntwo\n3\n", "line 3\n3\ntwo\n1\n"},
+		{".step", "3\ntwo\n1\n", "done"},
+		{".step", "3\ntwo\n1\n", "nothing to step through"},
+		{".step s/^/>/", "3\ntwo\n1\n", "line 1\n>3\n"},
+		{".undo", "3\ntwo\n1\n", "stopped stepping"},
+		{"k", "3\ntwo\n1\n", "unknown command: `k'"},
+		{".goto x", "3\ntwo\n1\n", "invalid line number"},
+		{".bogus", "3\ntwo\n1\n", "unknown command .bogus"},
+	}
+	for i, c := range cases {
+		out.Reset()
+		if !r.exec(c.line) {
+			t.Fatalf("Test %d: %s stopped the REPL", i, c.line)
+		}
+		if r.buffer != c.buffer {
+			t.Errorf("Test %d: %s: expected buffer %q, got %q", i, c.line, c.buffer, r.buffer)
+		}
+		if !strings.Contains(out.String(), c.output) {
+			t.Errorf("Test %d: %s: expected output to contain %q, got %q", i, c.line, c.output, out.String())
+		}
+	}
+	if r.exec(".quit") {
+		t.Errorf("Expected .quit to stop the REPL")
+	}
+}
+
+// TestREPLMultiline checks that a command spanning lines is only run once
+// all of its lines have been typed in.
+func TestREPLMultiline(t *testing.T) {
+	var out bytes.Buffer
+	r := &repl{out: &out, buffer: "1\n2\n"}
+	cases := []struct {
+		line    string
+		buffer  string
+		pending bool
+	}{
+		{"1a\\", "1\n2\n", true},
+		{"after one\\", "1\n2\n", true},
+		{"and more", "1\nafter one\nand more\n2\n", false},
+		{"$a two", "1\nafter one\nand more\n2\ntwo\n", false},
+		{"/one/,/more/{", "1\nafter one\nand more\n2\ntwo\n", true},
+		{"  s/^/> /", "1\nafter one\nand more\n2\ntwo\n", true},
+		{"}", "1\n> after one\n> and more\n2\ntwo\n", false},
+		{"s/{/x/", "1\n> after one\n> and more\n2\ntwo\n", false},
+	}
+	for i, c := range cases {
+		out.Reset()
+		r.exec(c.line)
+		if r.buffer != c.buffer {
+			t.Errorf("Test %d: %s: expected buffer %q, got %q", i, c.line, c.buffer, r.buffer)
+		}
+		if pending := len(r.pending) > 0; pending != c.pending {
+			t.Errorf("Test %d: %s: expected the command to be pending %v, got %v", i, c.line, c.pending, pending)
+		}
+		if c.pending && out.Len() > 0 {
+			t.Errorf("Test %d: %s: expected no output while the command is pending, got %q", i, c.line, out.String())
+		}
+	}
+	if len(r.history) != 4 {
+		t.Errorf("Expected 4 commands in the history, got %d", len(r.history))
+	}
+}
+
+// TestREPLSave checks that loading a saved history does to the original
+// buffer what the commands did one after the other.
+func TestREPLSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := "one\ntwo\nthree\n"
+	r := &repl{out: ioutil.Discard, buffer: input}
+	for _, line := range []string{"s/o/0/g", "1d", "s/e/E/", ".undo", "1d", "$s/$/!/", "1i\\", "first"} {
+		r.exec(line)
+	}
+	script := filepath.Join(dir, "history.sed")
+	r.exec(".save " + script)
+	if _, err := os.Stat(script); !os.IsNotExist(err) {
+		t.Errorf("Expected no history to be saved to %s, got %v", script, err)
+	}
+	name := filepath.Join(dir, "history.txt")
+	r.exec(".save " + name)
+
+	history, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := historyHeader + "s/o/0/g\n1d\n1d\n$s/$/!/\n1i\\\nfirst\n"; string(history) != exp {
+		t.Errorf("Expected history %q, got %q", exp, history)
+	}
+
+	loaded := &repl{out: ioutil.Discard, buffer: input}
+	loaded.exec(".load " + name)
+	if loaded.buffer != r.buffer {
+		t.Errorf("Loaded history produced %q, expected %q", loaded.buffer, r.buffer)
+	}
+	if len(loaded.history) != 5 {
+		t.Errorf("Expected the 5 commands loaded to be in the history, got %d", len(loaded.history))
+	}
+}
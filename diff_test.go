@@ -0,0 +1,136 @@
+package gosed
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+type diffOp struct {
+	kind byte   // ' ' for a line in both, '-' for one only in a, '+' for one only in b.
+	line string // The line, with its newline if it has one.
+	a, b int    // The number of lines of a and b before this one.
+}
+
+// unifiedDiff returns the differences between a and b in the unified
+// format of diff -u, or "" if they are the same.
+func unifiedDiff(aName, bName, a, b string) string {
+	if a == b {
+		return ""
+	}
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var buff strings.Builder
+	fmt.Fprintf(&buff, "--- %s\n+++ %s\n", aName, bName)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk until the changes are more than twice the context
+		// apart.
+		start, end := i, i
+		for j := i; j < len(ops) && j <= end+2*diffContext; j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			}
+		}
+		if start -= diffContext; start < 0 {
+			start = 0
+		}
+		if end += diffContext; end >= len(ops) {
+			end = len(ops) - 1
+		}
+		writeHunk(&buff, ops[start:end+1])
+		i = end + 1
+	}
+	return buff.String()
+}
+
+// writeHunk writes the header and lines of a hunk made up of ops.
+func writeHunk(buff *strings.Builder, ops []diffOp) {
+	aLen, bLen := 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			aLen++
+		}
+		if op.kind != '-' {
+			bLen++
+		}
+	}
+	fmt.Fprintf(buff, "@@ -%s +%s @@\n", hunkRange(ops[0].a, aLen), hunkRange(ops[0].b, bLen))
+	for _, op := range ops {
+		buff.WriteByte(op.kind)
+		buff.WriteString(op.line)
+		if !strings.HasSuffix(op.line, "\n") {
+			buff.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange returns the range of lines of a hunk header for n lines after
+// the first before lines.
+func hunkRange(before, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, n)
+}
+
+// splitLines splits s after each newline.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the shortest edit turning a into b, found from the
+// longest common subsequence of their lines.
+func diffLines(a, b []string) []diffOp {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', line: a[i], a: i, b: j})
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{kind: '-', line: a[i], a: i, b: j})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', line: b[j], a: i, b: j})
+			j++
+		}
+	}
+	return ops
+}
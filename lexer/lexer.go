@@ -3,6 +3,7 @@ package lexer
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"unicode"
 
 	"github.com/zkry/go-sed/token"
@@ -22,6 +23,8 @@ const (
 	state2ndAddrStart state = "2ND_ADDR_START"
 	state2ndAddr      state = "2ND_ADDR"
 	stateEnd2ndAddr   state = "END_2ND_ADDR"
+	stateStep         state = "STEP"
+	state2ndStep      state = "2ND_STEP"
 
 	stateCmd state = "CMD" // The state after reading a command
 
@@ -62,6 +65,11 @@ func New(input string) *Lexer {
 	return l
 }
 
+// Input returns the program being lexed.
+func (l *Lexer) Input() string {
+	return string(l.input)
+}
+
 func (l *Lexer) readChar() {
 	if l.ch == '\n' {
 		l.row++
@@ -82,13 +90,10 @@ func (l *Lexer) readChar() {
 // readUntil w
 func (l *Lexer) readUntil(toFunc func(rune) bool) string {
 	buf := bytes.Buffer{}
-	fmt.Printf("l.ch = '%c'\n", l.ch)
 	for l.ch != 0 && !toFunc(l.ch) {
-		fmt.Printf("l.ch > '%c'\n", l.ch)
 		buf.WriteRune(l.ch)
 		l.readChar()
 	}
-	fmt.Printf("l.ch = '%c'\n", l.ch)
 	return buf.String()
 }
 
@@ -139,8 +144,9 @@ func isAlnum(r rune) bool {
 }
 
 // isASpace is different than unicode.IsSpace in that isASpace
+// does not treat newlines as spaces, as they delimit commands.
 func isASpace(r rune) bool {
-	return r == ' '
+	return r == ' ' || r == '\t'
 }
 
 func isNewline(r rune) bool {
@@ -155,6 +161,17 @@ func isNewlineOrEOF(r rune) bool {
 	return r == '\n' || r == 0
 }
 
+// isCmdEnd reports whether r ends the arguments of a command.
+func isCmdEnd(r rune) bool {
+	return isNewCommand(r) || r == '}' || r == '#'
+}
+
+// isLabelEnd reports whether r ends the name of a label. A } ends it too,
+// so that a branch can be the last command of a block.
+func isLabelEnd(r rune) bool {
+	return isNewCommand(r) || r == '}'
+}
+
 func not(f func(r rune) bool) func(rune) bool {
 	return func(r rune) bool {
 		return !f(r)
@@ -172,12 +189,13 @@ const debug = false
 func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 
-	startPos := l.position
+	startPos := l.offset()
 
 	// Check for the end of file
 	if l.ch == 0 {
 		tok.Literal = ""
 		tok.Type = token.EOF
+		tok.Start, tok.End = startPos, startPos
 		return tok
 	}
 
@@ -200,6 +218,10 @@ func (l *Lexer) NextToken() token.Token {
 		tok = l.lex2ndAddr()
 	case stateEnd2ndAddr:
 		tok = l.lexEnd2ndAddr()
+	case stateStep:
+		tok = l.lexStep(stateEndAddr)
+	case state2ndStep:
+		tok = l.lexStep(stateEnd2ndAddr)
 	case stateCmd:
 		tok = l.lexCmd()
 	case stateFindPtn:
@@ -217,10 +239,18 @@ func (l *Lexer) NextToken() token.Token {
 	}
 
 	tok.Start = startPos
-	tok.End = l.position
+	tok.End = l.offset()
 	return tok
 }
 
+// offset returns the index in the input of the current character.
+func (l *Lexer) offset() int {
+	if l.ch == 0 {
+		return len(l.input)
+	}
+	return l.position - 1
+}
+
 func (l *Lexer) lexStart() token.Token {
 	// Reset state
 	l.div = '/'
@@ -230,12 +260,15 @@ func (l *Lexer) lexStart() token.Token {
 
 	tok := token.Token{}
 	switch l.ch {
+	case 0:
+		tok.Type = token.EOF
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 		l.readChar()
 	case '#':
 		tok = newToken(token.NEWLINE, l.ch)
 		l.readUntil(isNewlineOrEOF)
+		l.readChar()
 	case '\n':
 		tok = newToken(token.NEWLINE, l.ch)
 		l.readChar()
@@ -251,9 +284,11 @@ func (l *Lexer) lexStart() token.Token {
 		tok = newToken(token.DOLLAR, l.ch)
 		l.s = stateEndAddr
 		l.readChar()
+	case '{':
+		tok = newToken(token.LBRACE, l.ch)
+		l.readChar()
 	case '}':
 		tok = newToken(token.RBRACE, l.ch)
-		l.readUntil(isNewCommand)
 		l.readChar()
 	case '\\':
 		l.readChar()
@@ -267,65 +302,412 @@ func (l *Lexer) lexStart() token.Token {
 			tok.Type = token.INT
 			l.s = stateEndAddr
 		} else if isCmd(l.ch) {
-			tok = newToken(token.CMD, l.ch)
-			l.cmd = l.ch
-			l.s = stateCmd
-			l.readChar()
+			tok = l.lexCmdName()
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
 			l.readChar()
 		}
 	}
-	fmt.Printf("->'%c'\n", l.ch)
 	return tok
 }
 
+// lexCmdName reads the single character name of a command and prepares the
+// lexer to read the command's arguments.
+func (l *Lexer) lexCmdName() token.Token {
+	tok := newToken(token.CMD, l.ch)
+	l.cmd = l.ch
+	l.s = stateCmd
+	l.readChar()
+	return tok
+}
+
+// lexLabel reads the name of a label following a ':' character.
 func (l *Lexer) lexLabel() token.Token {
-	return token.Token{}
+	l.readWhile(isASpace)
+	lit := l.readUntil(isLabelEnd)
+	l.s = stateStart
+	return token.Token{Type: token.IDENT, Literal: strings.TrimRight(lit, " \t")}
 }
 
+// lexReadLine reads the text argument of the a, i and c commands. A
+// backslash followed by a newline continues the text onto the next line.
+// As in GNU sed, \n stands for a newline, along with \t, \r, \f, \v and
+// \a, while any other backslash is removed, leaving the character it
+// escapes.
 func (l *Lexer) lexReadLine() token.Token {
-	return token.Token{}
+	if l.prevCh == '\\' && l.ch == '\n' {
+		l.readChar()
+	}
+	buf := bytes.Buffer{}
+	for l.ch != 0 && l.ch != '\n' {
+		ch := l.ch
+		if ch == '\\' {
+			l.readChar()
+			if l.ch == 0 {
+				break
+			}
+			ch = textEscape(l.ch)
+		}
+		buf.WriteRune(ch)
+		l.readChar()
+	}
+	l.s = stateStart
+	return token.Token{Type: token.LIT, Literal: buf.String()}
 }
 
+// textEscape returns the character the escape \c stands for in the text of
+// the a, i and c commands.
+func textEscape(c rune) rune {
+	switch c {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case 'f':
+		return '\f'
+	case 'v':
+		return '\v'
+	case 'a':
+		return '\a'
+	}
+	return c
+}
+
+// lexPostFlag reads the file name given after the w flag of the s command.
 func (l *Lexer) lexPostFlag() token.Token {
-	return token.Token{}
+	l.readWhile(isASpace)
+	l.s = stateStart
+	return token.Token{Type: token.IDENT, Literal: l.readUntil(isNewlineOrEOF)}
 }
 
 // lexFlag extracts the flag portion of the s/1/2/f  pattern
 func (l *Lexer) lexFlag() token.Token {
-	return token.Token{}
+	switch {
+	case isASpace(l.ch):
+		l.readWhile(isASpace)
+		if isCmdEnd(l.ch) {
+			// Whitespace ends the flags, so the command is terminated
+			// here regardless of what follows.
+			l.s = stateStart
+			return newToken(token.SEMICOLON, ';')
+		}
+		return l.lexPostFlag()
+	case isCmdEnd(l.ch):
+		l.s = stateStart
+		return l.lexStart()
+	case l.ch == 'w':
+		tok := newToken(token.IDENT, l.ch)
+		l.s = statePostFlag
+		l.readChar()
+		return tok
+	case unicode.IsDigit(l.ch):
+		return token.Token{Type: token.IDENT, Literal: l.readWhile(unicode.IsDigit)}
+	case unicode.IsLetter(l.ch):
+		tok := newToken(token.IDENT, l.ch)
+		l.readChar()
+		return tok
+	}
+	tok := newToken(token.ILLEGAL, l.ch)
+	l.s = stateStart
+	l.readChar()
+	return tok
 }
 
 // lexReplace extracts the second part of the s/1/2/f pattern
 func (l *Lexer) lexReplace() token.Token {
-	return token.Token{}
+	if l.ch == l.div {
+		tok := newToken(token.DIV, l.ch)
+		if l.cmd == 'y' {
+			l.s = stateStart
+		} else {
+			l.s = stateFlags
+		}
+		l.readChar()
+		return tok
+	}
+	return l.lexPattern()
 }
 
+// lexFind extracts the first part of the s/1/2/f pattern
 func (l *Lexer) lexFind() token.Token {
-	return token.Token{}
+	if l.ch == l.div {
+		tok := newToken(token.DIV, l.ch)
+		l.s = stateReplacePtn
+		l.readChar()
+		return tok
+	}
+	return l.lexPattern()
 }
 
+// lexPattern reads one of the operands of the s and y commands up to the
+// next unescaped divider. A backslash before the divider is dropped and a
+// backslash followed by a newline becomes a newline. All other escapes are
+// left for the parser to interpret. The divider does not end a bracket
+// expression of the regexp of s.
+func (l *Lexer) lexPattern() token.Token {
+	if l.ch == '\n' {
+		// Operands can not span lines without escaping the newline.
+		tok := newToken(token.ILLEGAL, l.ch)
+		l.s = stateStart
+		return tok
+	}
+	buf := bytes.Buffer{}
+	for l.ch != 0 && l.ch != l.div && l.ch != '\n' {
+		if l.ch == '[' && l.cmd == 's' && l.s == stateFindPtn {
+			l.readBracket(&buf)
+			continue
+		}
+		if l.ch == '\\' {
+			l.readChar()
+			switch {
+			case l.ch == 0:
+				buf.WriteRune('\\')
+				continue
+			case l.ch == '&' && l.s == stateReplacePtn:
+				// An escaped & delimiter is still a literal & in the
+				// replacement, not the whole match.
+				buf.WriteRune('\\')
+			case l.ch == l.div, l.ch == '\n':
+			default:
+				buf.WriteRune('\\')
+			}
+		}
+		buf.WriteRune(l.ch)
+		l.readChar()
+	}
+	return token.Token{Type: token.LIT, Literal: buf.String()}
+}
+
+// lexCmd reads the arguments that follow a command. What is read depends
+// on the command that was last read.
 func (l *Lexer) lexCmd() token.Token {
-	return token.Token{}
+	switch l.cmd {
+	case 's', 'y':
+		if l.ch == '\n' || l.ch == '\\' {
+			l.s = stateStart
+			tok := newToken(token.ILLEGAL, l.ch)
+			l.readChar()
+			return tok
+		}
+		l.div = l.ch
+		l.s = stateFindPtn
+		tok := newToken(token.DIV, l.ch)
+		l.readChar()
+		return tok
+	case 'a', 'i', 'c':
+		l.readWhile(isASpace)
+		if l.ch == '\\' {
+			tok := newToken(token.BACKSLASH, l.ch)
+			l.s = stateReadline
+			l.readChar()
+			return tok
+		}
+		return l.lexReadLine()
+	case 'b', 't', 'T', 'v':
+		l.readWhile(isASpace)
+		if isCmdEnd(l.ch) {
+			l.s = stateStart
+			return l.lexStart()
+		}
+		return l.lexLabel()
+	case 'l', 'q', 'Q':
+		// An optional number follows.
+		l.readWhile(isASpace)
+		if unicode.IsDigit(l.ch) {
+			l.s = stateStart
+			return token.Token{Type: token.INT, Literal: l.readWhile(unicode.IsDigit)}
+		}
+	case 'r', 'R', 'w', 'W', 'e':
+		l.readWhile(isASpace)
+		l.s = stateStart
+		return token.Token{Type: token.IDENT, Literal: l.readUntil(isNewlineOrEOF)}
+	}
+	l.s = stateStart
+	return l.lexStart()
 }
 
+// lexEnd2ndAddr reads what follows the second address of a range.
 func (l *Lexer) lexEnd2ndAddr() token.Token {
-	return token.Token{}
+	l.readWhile(isASpace)
+	switch {
+	case l.ch == 'I' || l.ch == 'M':
+		// The modifiers of a regexp address, as there are no commands by
+		// these names.
+		tok := newToken(token.IDENT, l.ch)
+		l.readChar()
+		return tok
+	case l.ch == '!':
+		tok := newToken(token.EXPLMARK, l.ch)
+		l.readChar()
+		return tok
+	case l.ch == '{':
+		l.s = stateStart
+		tok := newToken(token.LBRACE, l.ch)
+		l.readChar()
+		return tok
+	case isCmd(l.ch):
+		return l.lexCmdName()
+	}
+	l.s = stateStart
+	tok := newToken(token.ILLEGAL, l.ch)
+	l.readChar()
+	return tok
 }
 
+// lex2ndAddrStart reads the beginning of the address following a comma.
 func (l *Lexer) lex2ndAddrStart() token.Token {
-	return token.Token{}
+	l.readWhile(isASpace)
+	var tok token.Token
+	switch {
+	case l.ch == '/':
+		tok = newToken(token.SLASH, l.ch)
+		l.addrDiv = l.ch
+		l.s = state2ndAddr
+		l.readChar()
+	case l.ch == '\\':
+		l.readChar()
+		l.addrDiv = l.ch
+		l.s = state2ndAddr
+		tok = newToken(token.SLASH, l.ch)
+		l.readChar()
+	case l.ch == '$':
+		tok = newToken(token.DOLLAR, l.ch)
+		l.s = stateEnd2ndAddr
+		l.readChar()
+	case l.ch == '+':
+		tok = newToken(token.PLUS, l.ch)
+		l.s = state2ndStep
+		l.readChar()
+	case l.ch == '~':
+		tok = newToken(token.TILDE, l.ch)
+		l.s = state2ndStep
+		l.readChar()
+	case unicode.IsDigit(l.ch):
+		tok.Literal = l.readWhile(unicode.IsDigit)
+		tok.Type = token.INT
+		l.s = stateEnd2ndAddr
+	default:
+		tok = newToken(token.ILLEGAL, l.ch)
+		l.s = stateStart
+		l.readChar()
+	}
+	return tok
 }
 
+// lex2ndAddr reads the regular expression of the second address.
 func (l *Lexer) lex2ndAddr() token.Token {
-	return token.Token{}
+	return l.lexRegexpAddr(stateEnd2ndAddr)
 }
 
+// lexEndAddr reads what follows the first address.
 func (l *Lexer) lexEndAddr() token.Token {
-	return token.Token{}
+	l.readWhile(isASpace)
+	switch l.ch {
+	case ',':
+		tok := newToken(token.COMMA, l.ch)
+		l.s = state2ndAddrStart
+		l.readChar()
+		return tok
+	case '~':
+		tok := newToken(token.TILDE, l.ch)
+		l.s = stateStep
+		l.readChar()
+		return tok
+	}
+	return l.lexEnd2ndAddr()
 }
 
+// lexStep reads the number following a + or ~ in an address, after which
+// the lexer moves to the next state.
+func (l *Lexer) lexStep(next state) token.Token {
+	if !unicode.IsDigit(l.ch) {
+		l.s = stateStart
+		tok := newToken(token.ILLEGAL, l.ch)
+		l.readChar()
+		return tok
+	}
+	l.s = next
+	return token.Token{Type: token.INT, Literal: l.readWhile(unicode.IsDigit)}
+}
+
+// lexAddr reads the regular expression of the first address.
 func (l *Lexer) lexAddr() token.Token {
-	return token.Token{}
+	return l.lexRegexpAddr(stateEndAddr)
+}
+
+// lexRegexpAddr reads the contents of a regular expression address up to
+// its closing divider, after which the lexer moves to the next state. The
+// contents are returned as written, escapes included. The divider does not
+// end a bracket expression.
+func (l *Lexer) lexRegexpAddr(next state) token.Token {
+	if l.ch == l.addrDiv {
+		tok := newToken(token.SLASH, l.ch)
+		l.s = next
+		l.readChar()
+		return tok
+	}
+	buf := bytes.Buffer{}
+	for l.ch != 0 && l.ch != l.addrDiv && l.ch != '\n' {
+		if l.ch == '[' {
+			l.readBracket(&buf)
+			continue
+		}
+		if l.ch == '\\' {
+			buf.WriteRune(l.ch)
+			l.readChar()
+			if l.ch == 0 {
+				break
+			}
+		}
+		buf.WriteRune(l.ch)
+		l.readChar()
+	}
+	if l.ch == '\n' {
+		// An unterminated address; let the start state report the rest.
+		l.s = stateStart
+	}
+	return token.Token{Type: token.LIT, Literal: buf.String()}
+}
+
+// readBracket copies the bracket expression starting at the current '['
+// to buf as written. Within it the dividers and backslashes are ordinary
+// characters, so only a ']' ends it. A ']' that comes first in the list,
+// after an optional '^', stands for itself, as does the ']' closing a
+// [:class:], [=x=] or [.x.]. An unterminated expression runs to the end
+// of the line.
+func (l *Lexer) readBracket(buf *bytes.Buffer) {
+	buf.WriteRune(l.ch)
+	l.readChar()
+	if l.ch == '^' {
+		buf.WriteRune(l.ch)
+		l.readChar()
+	}
+	if l.ch == ']' {
+		buf.WriteRune(l.ch)
+		l.readChar()
+	}
+	for l.ch != 0 && l.ch != '\n' {
+		c := l.ch
+		buf.WriteRune(c)
+		l.readChar()
+		switch {
+		case c == ']':
+			return
+		case c == '[' && (l.ch == ':' || l.ch == '=' || l.ch == '.'):
+			delim := l.ch
+			buf.WriteRune(delim)
+			l.readChar()
+			for prev := rune(0); l.ch != 0 && l.ch != '\n'; {
+				closing := prev == delim && l.ch == ']'
+				prev = l.ch
+				buf.WriteRune(l.ch)
+				l.readChar()
+				if closing {
+					break
+				}
+			}
+		}
+	}
 }
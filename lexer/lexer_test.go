@@ -1504,12 +1504,17 @@ a \
 		},
 	},
 	{
+		// Each address is \s\ss, an address delimited by s holding an
+		// escaped s, which is returned as written. The addresses are
+		// separated by a COMMA.
 		program: `\s\ss,\s\ssss\ss\s\sswsss`,
 		expected: []token.Token{
 			token.Token{Type: token.SLASH, Literal: "s"},
+			token.Token{Type: token.LIT, Literal: `\s`},
 			token.Token{Type: token.SLASH, Literal: "s"},
-			token.Token{Type: token.SEMICOLON, Literal: ";"},
+			token.Token{Type: token.COMMA, Literal: ","},
 			token.Token{Type: token.SLASH, Literal: "s"},
+			token.Token{Type: token.LIT, Literal: `\s`},
 			token.Token{Type: token.SLASH, Literal: "s"},
 
 			token.Token{Type: token.CMD, Literal: "s"},
@@ -1526,4 +1531,152 @@ a \
 			token.Token{Type: token.EOF, Literal: ""},
 		},
 	},
+	{
+		program: `a\
+first\
+second
+r in.txt
+w out.txt`,
+		expected: []token.Token{
+			token.Token{Type: token.CMD, Literal: "a"},
+			token.Token{Type: token.BACKSLASH, Literal: "\\"},
+			token.Token{Type: token.LIT, Literal: "first\nsecond"},
+			token.Token{Type: token.NEWLINE, Literal: "\n"},
+			token.Token{Type: token.CMD, Literal: "r"},
+			token.Token{Type: token.IDENT, Literal: "in.txt"},
+			token.Token{Type: token.NEWLINE, Literal: "\n"},
+			token.Token{Type: token.CMD, Literal: "w"},
+			token.Token{Type: token.IDENT, Literal: "out.txt"},
+			token.Token{Type: token.EOF, Literal: ""},
+		},
+	},
+	{
+		program: `y|a\|b|x\|y|;t end;b`,
+		expected: []token.Token{
+			token.Token{Type: token.CMD, Literal: "y"},
+			token.Token{Type: token.DIV, Literal: "|"},
+			token.Token{Type: token.LIT, Literal: "a|b"},
+			token.Token{Type: token.DIV, Literal: "|"},
+			token.Token{Type: token.LIT, Literal: "x|y"},
+			token.Token{Type: token.DIV, Literal: "|"},
+			token.Token{Type: token.SEMICOLON, Literal: ";"},
+			token.Token{Type: token.CMD, Literal: "t"},
+			token.Token{Type: token.IDENT, Literal: "end"},
+			token.Token{Type: token.SEMICOLON, Literal: ";"},
+			token.Token{Type: token.CMD, Literal: "b"},
+			token.Token{Type: token.EOF, Literal: ""},
+		},
+	},
+	{
+		program: `1{p}`,
+		expected: []token.Token{
+			token.Token{Type: token.INT, Literal: "1"},
+			token.Token{Type: token.LBRACE, Literal: "{"},
+			token.Token{Type: token.CMD, Literal: "p"},
+			token.Token{Type: token.RBRACE, Literal: "}"},
+			token.Token{Type: token.EOF, Literal: ""},
+		},
+	},
+	{
+		program: `0~3p;2,+4d;/a/I,~4M!p`,
+		expected: []token.Token{
+			token.Token{Type: token.INT, Literal: "0"},
+			token.Token{Type: token.TILDE, Literal: "~"},
+			token.Token{Type: token.INT, Literal: "3"},
+			token.Token{Type: token.CMD, Literal: "p"},
+			token.Token{Type: token.SEMICOLON, Literal: ";"},
+			token.Token{Type: token.INT, Literal: "2"},
+			token.Token{Type: token.COMMA, Literal: ","},
+			token.Token{Type: token.PLUS, Literal: "+"},
+			token.Token{Type: token.INT, Literal: "4"},
+			token.Token{Type: token.CMD, Literal: "d"},
+			token.Token{Type: token.SEMICOLON, Literal: ";"},
+			token.Token{Type: token.SLASH, Literal: "/"},
+			token.Token{Type: token.LIT, Literal: "a"},
+			token.Token{Type: token.SLASH, Literal: "/"},
+			token.Token{Type: token.IDENT, Literal: "I"},
+			token.Token{Type: token.COMMA, Literal: ","},
+			token.Token{Type: token.TILDE, Literal: "~"},
+			token.Token{Type: token.INT, Literal: "4"},
+			token.Token{Type: token.IDENT, Literal: "M"},
+			token.Token{Type: token.EXPLMARK, Literal: "!"},
+			token.Token{Type: token.CMD, Literal: "p"},
+			token.Token{Type: token.EOF, Literal: ""},
+		},
+	},
+	{
+		program: `s/[^/]*$//;/[/]/p;s,[,],X,`,
+		expected: []token.Token{
+			token.Token{Type: token.CMD, Literal: "s"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.LIT, Literal: "[^/]*$"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.SEMICOLON, Literal: ";"},
+			token.Token{Type: token.SLASH, Literal: "/"},
+			token.Token{Type: token.LIT, Literal: "[/]"},
+			token.Token{Type: token.SLASH, Literal: "/"},
+			token.Token{Type: token.CMD, Literal: "p"},
+			token.Token{Type: token.SEMICOLON, Literal: ";"},
+			token.Token{Type: token.CMD, Literal: "s"},
+			token.Token{Type: token.DIV, Literal: ","},
+			token.Token{Type: token.LIT, Literal: "[,]"},
+			token.Token{Type: token.DIV, Literal: ","},
+			token.Token{Type: token.LIT, Literal: "X"},
+			token.Token{Type: token.DIV, Literal: ","},
+			token.Token{Type: token.EOF, Literal: ""},
+		},
+	},
+	{
+		program: `s/[]/]/[&]/;s/[^]/]//;\:[[:digit:]/]:d;s/[[=/=][./.]]/x/`,
+		expected: []token.Token{
+			token.Token{Type: token.CMD, Literal: "s"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.LIT, Literal: "[]/]"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.LIT, Literal: "[&]"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.SEMICOLON, Literal: ";"},
+			token.Token{Type: token.CMD, Literal: "s"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.LIT, Literal: "[^]/]"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.SEMICOLON, Literal: ";"},
+			token.Token{Type: token.SLASH, Literal: ":"},
+			token.Token{Type: token.LIT, Literal: "[[:digit:]/]"},
+			token.Token{Type: token.SLASH, Literal: ":"},
+			token.Token{Type: token.CMD, Literal: "d"},
+			token.Token{Type: token.SEMICOLON, Literal: ";"},
+			token.Token{Type: token.CMD, Literal: "s"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.LIT, Literal: "[[=/=][./.]]"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.LIT, Literal: "x"},
+			token.Token{Type: token.DIV, Literal: "/"},
+			token.Token{Type: token.EOF, Literal: ""},
+		},
+	},
+	{
+		program: "1a hello\n$i\\  two",
+		expected: []token.Token{
+			token.Token{Type: token.INT, Literal: "1"},
+			token.Token{Type: token.CMD, Literal: "a"},
+			token.Token{Type: token.LIT, Literal: "hello"},
+			token.Token{Type: token.NEWLINE, Literal: "\n"},
+			token.Token{Type: token.DOLLAR, Literal: "$"},
+			token.Token{Type: token.CMD, Literal: "i"},
+			token.Token{Type: token.BACKSLASH, Literal: "\\"},
+			token.Token{Type: token.LIT, Literal: "  two"},
+			token.Token{Type: token.EOF, Literal: ""},
+		},
+	},
+	{
+		program: `a foo\tbar\nbaz\\q\qz`,
+		expected: []token.Token{
+			token.Token{Type: token.CMD, Literal: "a"},
+			token.Token{Type: token.LIT, Literal: "foo\tbar\nbaz\\qqz"},
+			token.Token{Type: token.EOF, Literal: ""},
+		},
+	},
 }
@@ -0,0 +1,562 @@
+// Package posix translates POSIX regular expressions, along with the GNU
+// extensions understood by sed, into the RE2 syntax used by package regexp.
+package posix
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zkry/go-sed/backtrack"
+)
+
+// Dialect is the flavour of regular expression being translated.
+type Dialect int
+
+const (
+	BRE Dialect = iota // Basic regular expressions, used by sed by default.
+	ERE                // Extended regular expressions, used by sed -E.
+)
+
+var (
+	ErrTrailingBackslash = errors.New("trailing backslash (\\)")
+	ErrBracket           = errors.New("unterminated [ in bracket expression")
+	ErrInterval          = errors.New("unterminated \\{ in interval expression")
+	ErrPreceding         = errors.New("invalid preceding regular expression")
+	ErrBackref           = errors.New("back-references can not be translated to RE2")
+	ErrWordAnchor        = errors.New("\\< and \\> can not be translated to RE2")
+)
+
+// classes are the character class names that can appear between [: and :]
+// in a bracket expression.
+var classes = map[string]bool{
+	"alnum": true, "alpha": true, "blank": true, "cntrl": true,
+	"digit": true, "graph": true, "lower": true, "print": true,
+	"punct": true, "space": true, "upper": true, "xdigit": true,
+}
+
+// Flags change how a compiled pattern matches.
+type Flags int
+
+const (
+	IgnoreCase Flags = 1 << iota // Letters match regardless of case, the I flag of sed.
+	Multiline                    // ^ and $ also match around embedded newlines, the M flag of sed.
+)
+
+// prefix returns the RE2 flags set by flags. Unless in multiline mode,
+// '.' also matches a newline.
+func (flags Flags) prefix() string {
+	f := ""
+	if flags&IgnoreCase != 0 {
+		f += "i"
+	}
+	if flags&Multiline != 0 {
+		f += "m"
+	} else {
+		f += "s"
+	}
+	return "(?" + f + ")"
+}
+
+// Matcher is a compiled regular expression. It is implemented by both
+// *regexp.Regexp and the *backtrack.Regexp used for patterns containing
+// back-references or \< and \>.
+type Matcher interface {
+	MatchString(s string) bool
+	FindStringSubmatchIndex(s string) []int
+	FindAllStringSubmatchIndex(s string, n int) [][]int
+	NumSubexp() int
+	String() string
+}
+
+// limited is implemented by the matchers whose searches may give up, like
+// those of package backtrack, which then return an error.
+type limited interface {
+	MatchStringErr(s string) (bool, error)
+	FindAllStringSubmatchIndexErr(s string, n int) ([][]int, error)
+}
+
+// MatchString reports whether s contains any match of m. If the search
+// gave up, as one of package backtrack may, the error is returned.
+func MatchString(m Matcher, s string) (bool, error) {
+	if l, ok := m.(limited); ok {
+		return l.MatchStringErr(s)
+	}
+	return m.MatchString(s), nil
+}
+
+// FindAllStringSubmatchIndex returns up to n successive matches of m in s
+// like the method of the same name. If a search gave up, as one of
+// package backtrack may, the error is returned along with the matches
+// found before.
+func FindAllStringSubmatchIndex(m Matcher, s string, n int) ([][]int, error) {
+	if l, ok := m.(limited); ok {
+		return l.FindAllStringSubmatchIndexErr(s, n)
+	}
+	return m.FindAllStringSubmatchIndex(s, n), nil
+}
+
+// Compile translates pattern from the dialect d and compiles it with the
+// given flags. As in sed, '.' in the compiled expression also matches a
+// newline, except in multiline mode where neither '.' nor a negated
+// bracket expression match one. Patterns with back-references or \< and
+// \>, which RE2 can not express, are matched by a backtracking matcher.
+func Compile(pattern string, d Dialect, flags Flags) (Matcher, error) {
+	t, err := translate(pattern, d, flags&Multiline != 0)
+	if err != nil {
+		return nil, err
+	}
+	re := t.out.String()
+	// POSIX requires the leftmost-longest match, not the first one found.
+	if t.backrefs || t.wordAnchors {
+		bre, err := backtrack.Compile(flags.prefix() + re)
+		if err != nil {
+			return nil, err
+		}
+		bre.Longest()
+		return bre, nil
+	}
+	rre, err := regexp.Compile(flags.prefix() + re)
+	if err != nil {
+		return nil, err
+	}
+	rre.Longest()
+	return rre, nil
+}
+
+// Translate returns the RE2 equivalent of pattern, a regular expression in
+// the dialect d. Patterns with back-references or with \< and \> have no
+// equivalent and return ErrBackref and ErrWordAnchor.
+func Translate(pattern string, d Dialect) (string, error) {
+	t, err := translate(pattern, d, false)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case t.backrefs:
+		err = ErrBackref
+	case t.wordAnchors:
+		err = ErrWordAnchor
+	}
+	return t.out.String(), err
+}
+
+// translate translates pattern to RE2 syntax, extended with back-references
+// and \< and \> as understood by package backtrack. If multiline is set,
+// negated bracket expressions do not match a newline.
+func translate(pattern string, d Dialect, multiline bool) (*translator, error) {
+	t := &translator{src: []rune(pattern), d: d, atStart: true, multiline: multiline}
+	for !t.eof() {
+		if err := t.next(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+type translator struct {
+	src []rune
+	pos int
+	d   Dialect
+	out strings.Builder
+
+	// atStart is set where a repetition operator has nothing to repeat,
+	// at the start of the expression, a group or an alternative. There
+	// '*' is a literal and in BRE '^' is an anchor, unless it follows the
+	// anchor.
+	atStart bool
+	anchor  bool // Whether a ^ anchor was the last thing written.
+
+	// The offset in out of the last atom written, or of its group, and the
+	// repetition operator written after it, if any.
+	atom   int
+	rep    string
+	groups []int // The offsets in out of the groups not closed yet.
+
+	backrefs    bool // Whether the pattern has back-references.
+	wordAnchors bool // Whether the pattern has \< or \>.
+	multiline   bool // Whether negated bracket expressions exclude newlines.
+}
+
+func (t *translator) eof() bool {
+	return t.pos >= len(t.src)
+}
+
+// peek reports whether the untranslated part of the pattern starts with s.
+func (t *translator) peek(s string) bool {
+	return t.hasPrefixAt(t.pos, s)
+}
+
+// index returns the offset from the current position of the next s, or -1.
+func (t *translator) index(s string) int {
+	for i := t.pos; i < len(t.src); i++ {
+		if t.hasPrefixAt(i, s) {
+			return i - t.pos
+		}
+	}
+	return -1
+}
+
+func (t *translator) hasPrefixAt(i int, s string) bool {
+	for _, c := range s {
+		if i >= len(t.src) || t.src[i] != c {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// emit writes s as an atom that can be repeated.
+func (t *translator) emit(s string) {
+	t.atom = t.out.Len()
+	t.out.WriteString(s)
+	t.atStart, t.anchor, t.rep = false, false, ""
+}
+
+// close writes the ) closing a group, which becomes the atom that can be
+// repeated.
+func (t *translator) close() {
+	start := t.out.Len()
+	if n := len(t.groups); n > 0 {
+		start = t.groups[n-1]
+		t.groups = t.groups[:n-1]
+	}
+	t.emit(")")
+	t.atom = start
+}
+
+// repeat writes the repetition operator op. RE2 does not allow an
+// operator to repeat another, so a *, + or ? following one of them is
+// merged with it, while otherwise the atom repeated is put in a group
+// first. In BRE, as in GNU sed, a * or an interval can not follow another
+// operator.
+func (t *translator) repeat(op string) error {
+	if t.rep != "" {
+		if t.d == BRE && (op == "*" || strings.HasPrefix(op, "{")) {
+			return ErrPreceding
+		}
+		s := t.out.String()
+		t.out.Reset()
+		if merged := mergeRepeat(t.rep, op); merged != "" {
+			t.out.WriteString(s[:len(s)-len(t.rep)])
+			op = merged
+		} else {
+			t.out.WriteString(s[:t.atom] + "(?:" + s[t.atom:] + ")")
+		}
+	}
+	t.out.WriteString(op)
+	t.rep = op
+	t.atStart, t.anchor = false, false
+	return nil
+}
+
+// mergeRepeat returns the operator repeating as (x{a}){b} does, where a
+// and b are *, + or ?, or "" for other operators.
+func mergeRepeat(a, b string) string {
+	if !strings.Contains("*+?", a) || !strings.Contains("*+?", b) {
+		return ""
+	}
+	none := a != "+" || b != "+"
+	many := a != "?" || b != "?"
+	switch {
+	case none && many:
+		return "*"
+	case none:
+		return "?"
+	}
+	return "+"
+}
+
+// literal writes the character c so that it only matches itself.
+func (t *translator) literal(c rune) {
+	t.emit(regexp.QuoteMeta(string(c)))
+}
+
+// open writes s, after which the expression starts anew. An opening
+// parenthesis starts a group.
+func (t *translator) open(s string) {
+	if s == "(" {
+		t.groups = append(t.groups, t.out.Len())
+	}
+	t.out.WriteString(s)
+	t.atStart, t.anchor, t.rep = true, false, ""
+}
+
+func (t *translator) next() error {
+	c := t.src[t.pos]
+	t.pos++
+	switch c {
+	case '\\':
+		return t.escape()
+	case '[':
+		return t.bracket()
+	case '.':
+		t.emit(".")
+	case '*':
+		if t.atStart {
+			t.literal(c)
+		} else {
+			return t.repeat("*")
+		}
+	case '^':
+		if t.d == ERE || t.atStart && !t.anchor {
+			t.open("^")
+			t.anchor = true
+		} else {
+			t.literal(c)
+		}
+	case '$':
+		if t.d == ERE || t.eof() || t.peek(`\)`) || t.peek(`\|`) {
+			t.emit("$")
+		} else {
+			t.literal(c)
+		}
+	case '(', '|':
+		if t.d == ERE {
+			t.open(string(c))
+		} else {
+			t.literal(c)
+		}
+	case ')':
+		if t.d == ERE {
+			t.close()
+		} else {
+			t.literal(c)
+		}
+	case '+', '?':
+		if t.d == ERE && !t.atStart {
+			return t.repeat(string(c))
+		}
+		t.literal(c)
+	case '{':
+		if t.d == ERE && !t.atStart {
+			return t.interval("}")
+		}
+		t.literal(c)
+	default:
+		t.literal(c)
+	}
+	return nil
+}
+
+// escape translates the escape sequence following a backslash.
+func (t *translator) escape() error {
+	if t.eof() {
+		return ErrTrailingBackslash
+	}
+	c := t.src[t.pos]
+	t.pos++
+	if t.d == BRE {
+		switch c {
+		case '(', '|':
+			t.open(string(c))
+			return nil
+		case ')':
+			t.close()
+			return nil
+		case '+', '?':
+			if t.atStart {
+				t.literal(c)
+				return nil
+			}
+			return t.repeat(string(c))
+		case '{':
+			return t.interval(`\}`)
+		}
+	}
+	switch c {
+	case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		t.backrefs = true
+		t.emit(`\` + string(c))
+	case 'n', 't', 'r', 'f', 'v', 'a', 'w', 'W', 's', 'S', 'b', 'B':
+		t.emit(`\` + string(c))
+	case '<', '>':
+		// RE2 has no start and end of word assertions, unlike package
+		// backtrack.
+		t.wordAnchors = true
+		t.emit(`\` + string(c))
+	case '`':
+		t.emit(`\A`)
+	case '\'':
+		t.emit(`\z`)
+	case 'c':
+		if t.eof() {
+			return ErrTrailingBackslash
+		}
+		t.literal(unicode.ToUpper(t.src[t.pos]) ^ 0x40)
+		t.pos++
+	case 'd':
+		t.literal(t.number(10, 3))
+	case 'o':
+		t.literal(t.number(8, 3))
+	case 'x':
+		t.literal(t.number(16, 2))
+	default:
+		t.literal(c)
+	}
+	return nil
+}
+
+// number reads up to n digits in base as the code of a character. With no
+// digits, the letter introducing the escape is returned instead.
+func (t *translator) number(base, n int) rune {
+	end := t.pos
+	for end < len(t.src) && end-t.pos < n {
+		if _, err := strconv.ParseUint(string(t.src[end]), base, 8); err != nil {
+			break
+		}
+		end++
+	}
+	if end == t.pos {
+		return t.src[t.pos-1]
+	}
+	v, err := strconv.ParseUint(string(t.src[t.pos:end]), base, 32)
+	if err != nil {
+		return t.src[t.pos-1]
+	}
+	t.pos = end
+	return rune(v)
+}
+
+// interval copies an interval expression, {m,n}, whose opening brace has
+// been read already. In BRE the braces are written with backslashes.
+func (t *translator) interval(closing string) error {
+	if t.atStart {
+		return ErrPreceding
+	}
+	end := t.index(closing)
+	if end < 0 {
+		return ErrInterval
+	}
+	body := string(t.src[t.pos : t.pos+end])
+	for _, c := range body {
+		if c != ',' && (c < '0' || c > '9') {
+			return errors.New("invalid content of \\{\\}")
+		}
+	}
+	t.pos += end + len(closing)
+	// A missing minimum is 0, which RE2 requires to be written out.
+	if strings.HasPrefix(body, ",") {
+		body = "0" + body
+	}
+	return t.repeat("{" + body + "}")
+}
+
+// bracket translates a bracket expression. The '[' has been read already.
+// Within the expression backslash is an ordinary character, except for the
+// GNU escapes such as \n and \t, and a ']' right after the opening bracket
+// stands for itself.
+func (t *translator) bracket() error {
+	var b strings.Builder
+	b.WriteByte('[')
+	if t.peek("^") {
+		b.WriteByte('^')
+		t.pos++
+		if t.multiline {
+			b.WriteString(`\n`)
+		}
+	}
+	first := true
+	for {
+		if t.eof() {
+			return ErrBracket
+		}
+		if t.src[t.pos] == ']' && !first {
+			t.pos++
+			break
+		}
+		first = false
+		lo, class, err := t.bracketItem()
+		if err != nil {
+			return err
+		}
+		if class != "" {
+			b.WriteString(class)
+			continue
+		}
+		if t.peek("-") && !t.peek("-]") && t.pos+1 < len(t.src) {
+			t.pos++
+			hi, class, err := t.bracketItem()
+			if err != nil {
+				return err
+			}
+			if class != "" {
+				return errors.New("invalid range end")
+			}
+			b.WriteString(classChar(lo) + "-" + classChar(hi))
+			continue
+		}
+		b.WriteString(classChar(lo))
+	}
+	b.WriteByte(']')
+	t.emit(b.String())
+	return nil
+}
+
+// bracketItem reads a single character of a bracket expression, or a
+// character class, which is returned in RE2 syntax.
+func (t *translator) bracketItem() (c rune, class string, err error) {
+	c = t.src[t.pos]
+	t.pos++
+	switch {
+	case c == '[' && (t.peek(":") || t.peek("=") || t.peek(".")):
+		delim := string(t.src[t.pos])
+		t.pos++
+		end := t.index(delim + "]")
+		if end < 0 {
+			return 0, "", ErrBracket
+		}
+		name := string(t.src[t.pos : t.pos+end])
+		t.pos += end + 2
+		if delim == ":" {
+			if !classes[name] {
+				return 0, "", errors.New("invalid character class " + name)
+			}
+			return 0, "[:" + name + ":]", nil
+		}
+		// Equivalence classes and collating symbols are only supported for
+		// single characters, which stand for themselves.
+		r := []rune(name)
+		if len(r) != 1 {
+			return 0, "", errors.New("invalid collation character " + name)
+		}
+		return r[0], "", nil
+	case c == '\\' && !t.eof():
+		switch t.src[t.pos] {
+		case 'n':
+			c = '\n'
+		case 't':
+			c = '\t'
+		case 'r':
+			c = '\r'
+		case 'f':
+			c = '\f'
+		case 'v':
+			c = '\v'
+		case 'a':
+			c = '\a'
+		case '\\':
+			c = '\\'
+		default:
+			return c, "", nil
+		}
+		t.pos++
+	}
+	return c, "", nil
+}
+
+// classChar returns c written so that it stands for itself in an RE2
+// character class.
+func classChar(c rune) string {
+	switch {
+	case c == '\n':
+		return `\n`
+	case c < utf8.RuneSelf && (unicode.IsPunct(c) || unicode.IsSymbol(c)):
+		return `\` + string(c)
+	}
+	return string(c)
+}
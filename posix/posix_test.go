@@ -0,0 +1,136 @@
+package posix
+
+import "testing"
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		pattern string
+		dialect Dialect
+		re2     string
+		isError bool
+	}{
+		{pattern: `abc`, re2: `abc`},
+		{pattern: `a\(b\)c`, re2: `a(b)c`},
+		{pattern: `a(b)c`, re2: `a\(b\)c`},
+		{pattern: `a\{2,3\}`, re2: `a{2,3}`},
+		{pattern: `a{2,3}`, re2: `a\{2,3\}`},
+		{pattern: `a\{,3\}`, re2: `a{0,3}`},
+		{pattern: `a\+b\?`, re2: `a+b?`},
+		{pattern: `a+b?`, re2: `a\+b\?`},
+		{pattern: `a\|b`, re2: `a|b`},
+		{pattern: `a|b`, re2: `a\|b`},
+		{pattern: `*a`, re2: `\*a`},
+		{pattern: `^*a`, re2: `^\*a`},
+		{pattern: `\(*a\)`, re2: `(\*a)`},
+		{pattern: `a^b$c`, re2: `a\^b\$c`},
+		{pattern: `^a$`, re2: `^a$`},
+		{pattern: `\(^a$\)`, re2: `(^a$)`},
+		{pattern: `^^a`, re2: `^\^a`},
+		{pattern: `\(^^\)`, re2: `(^\^)`},
+		{pattern: `^^*`, re2: `^\^*`},
+		{pattern: `a*\?b\+\?`, re2: `a*b*`},
+		{pattern: `a**`, isError: true},
+		{pattern: `a\{2\}*`, isError: true},
+		{pattern: `\.\*\[\\`, re2: `\.\*\[\\`},
+		{pattern: `a\nb\tc`, re2: `a\nb\tc`},
+		{pattern: `\bw\B`, re2: `\bw\B`},
+		{pattern: `\<w\>`, isError: true},
+		{pattern: `\x41\o102\d067\cA`, re2: "ABC\x01"},
+		{pattern: `[[:alpha:]]`, re2: `[[:alpha:]]`},
+		{pattern: `[^[:space:]x]`, re2: `[^[:space:]x]`},
+		{pattern: `[]abc]`, re2: `[\]abc]`},
+		{pattern: `[^]a]`, re2: `[^\]a]`},
+		{pattern: `[a-z0-9_-]`, re2: `[a-z0-9\_\-]`},
+		{pattern: `[\*.]`, re2: `[\\\*\.]`},
+		{pattern: `[\n]`, re2: `[\n]`},
+		{pattern: `[[=a=][.-.]]`, re2: `[a\-]`},
+		{pattern: `[[:foo:]]`, isError: true},
+		{pattern: `[abc`, isError: true},
+		{pattern: `[]`, isError: true},
+		{pattern: `a\{2`, isError: true},
+		{pattern: `\(a\)\1`, isError: true},
+		{pattern: `a\`, isError: true},
+		{pattern: `a(b|c)+d?`, dialect: ERE, re2: `a(b|c)+d?`},
+		{pattern: `a\(b\|c\)`, dialect: ERE, re2: `a\(b\|c\)`},
+		{pattern: `a{2}\{`, dialect: ERE, re2: `a{2}\{`},
+		{pattern: `a{,2}`, dialect: ERE, re2: `a{0,2}`},
+		{pattern: `*a|+b`, dialect: ERE, re2: `\*a|\+b`},
+		{pattern: `^^a`, dialect: ERE, re2: `^^a`},
+		{pattern: `a+*b??c++`, dialect: ERE, re2: `a*b?c+`},
+		{pattern: `a{2}*b*{3}`, dialect: ERE, re2: `(?:a{2})*(?:b*){3}`},
+		{pattern: `x(ab)+{2}?`, dialect: ERE, re2: `x(?:(?:(ab)+){2})?`},
+		{pattern: `[]a[:digit:]]`, dialect: ERE, re2: `[\]a[:digit:]]`},
+	}
+
+	for i, tt := range tests {
+		re2, err := Translate(tt.pattern, tt.dialect)
+		if tt.isError {
+			if err == nil {
+				t.Errorf("Pattern [%d] %s: expected an error, got %s", i, tt.pattern, re2)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Pattern [%d] %s: unexpected error %v", i, tt.pattern, err)
+			continue
+		}
+		if re2 != tt.re2 {
+			t.Errorf("Pattern [%d] %s: expected %s, got %s", i, tt.pattern, tt.re2, re2)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		pattern string
+		dialect Dialect
+		flags   Flags
+		input   string
+		match   string
+	}{
+		{pattern: `a.c`, input: "xa\ncx", match: "a\nc"},
+		{pattern: `x\{2\}`, input: "x xx xxx", match: "xx"},
+		{pattern: `x\{,2\}`, input: "xxxx", match: "xx"},
+		{pattern: `(x)`, input: "x (x)", match: "(x)"},
+		{pattern: `[[:digit:]]\+`, input: "ab123c", match: "123"},
+		{pattern: `[]]*`, input: "]]]a", match: "]]]"},
+		{pattern: `\(ab\)*c`, input: "xababcx", match: "ababc"},
+		{pattern: `(ab)*c`, dialect: ERE, input: "xababcx", match: "ababc"},
+		{pattern: `a|b`, dialect: ERE, input: "xb", match: "b"},
+		{pattern: `\(a*\)\1`, input: "baaaab", match: ""},
+		{pattern: `\(a\+\)\1`, input: "baaaab", match: "aaaa"},
+		{pattern: `\(.\)\1`, input: "abccd", match: "cc"},
+		{pattern: `(.)\1`, dialect: ERE, input: "abccd", match: "cc"},
+		{pattern: `abc`, flags: IgnoreCase, input: "xAbCx", match: "AbC"},
+		{pattern: `\(a\)\1`, flags: IgnoreCase, input: "xAax", match: "Aa"},
+		{pattern: `^b.*$`, flags: Multiline, input: "a\nbc\nd", match: "bc"},
+		{pattern: `b$`, dialect: ERE, flags: Multiline, input: "ab\nc", match: "b"},
+		{pattern: `b[^x]*`, flags: Multiline, input: "abc\nd", match: "bc"},
+		{pattern: `[^]x]*$`, flags: Multiline, input: "abc\nd", match: "abc"},
+		{pattern: `x\|xy`, input: "xyz", match: "xy"},
+		{pattern: `a\(b\|bc\)`, input: "abcd", match: "abc"},
+		{pattern: `\(e\|ee\)\1`, input: "eeee", match: "eeee"},
+		{pattern: `\<b`, input: "abc bd", match: "b"},
+		{pattern: `o*\>`, input: "foo bar", match: "oo"},
+		{pattern: `^^b`, input: "^b", match: "^b"},
+		{pattern: `a+*`, dialect: ERE, input: "baaac", match: ""},
+		{pattern: `ba+?`, dialect: ERE, input: "baaac", match: "baaa"},
+		{pattern: `(a){2}*c`, dialect: ERE, input: "baaaac", match: "aaaac"},
+	}
+
+	for i, tt := range tests {
+		re, err := Compile(tt.pattern, tt.dialect, tt.flags)
+		if err != nil {
+			t.Errorf("Pattern [%d] %s: unexpected error %v", i, tt.pattern, err)
+			continue
+		}
+		loc := re.FindStringSubmatchIndex(tt.input)
+		if loc == nil {
+			t.Errorf("Pattern [%d] %s: expected to match %q in %q", i, tt.pattern, tt.match, tt.input)
+			continue
+		}
+		if got := tt.input[loc[0]:loc[1]]; got != tt.match {
+			t.Errorf("Pattern [%d] %s: expected to match %q in %q, got %q", i, tt.pattern, tt.match, tt.input, got)
+		}
+	}
+}
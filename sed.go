@@ -1,43 +1,77 @@
 package gosed
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/zkry/go-sed/ast"
 	"github.com/zkry/go-sed/lexer"
+	"github.com/zkry/go-sed/posix"
 	"github.com/zkry/go-sed/token"
 )
 
 type Options struct {
-	SupressOutput     bool // Prevents program from automatically outputing line.
-	AppendFile        bool // Makes the w command append to file.
-	ExtendRegexp      bool // Use extended version of regexp
+	SupressOutput     bool       // Prevents program from automatically outputing line.
+	AppendFile        bool       // Makes the w command append to file.
+	ExtendRegexp      bool       // Use extended version of regexp
+	AllowExec         bool       // Lets the e flag of s run the pattern space as a shell command.
+	LineLength        int        // Width the l command wraps at. 0 means 70 and a negative width never wraps.
+	Posix             bool       // Follow POSIX where GNU sed differs, like sed with POSIXLY_CORRECT set.
+	Tracer            ast.Tracer // If set, told about each step of every run, to debug the program.
 	PreviousLinesRead int
 }
 
 func (opt *Options) baseRuntimeOptions() ast.RuntimeOptions {
 	return ast.RuntimeOptions{
-		AllowExec:  false,
+		AllowExec:  opt.AllowExec,
 		AutoPrint:  !opt.SupressOutput,
 		AppendFile: opt.AppendFile,
+		LineLength: opt.lineLength(),
+		Posix:      opt.Posix,
+		Tracer:     opt.Tracer,
 	}
 }
 
-type state struct {
-	linesRead int
+// DefaultLineLength is the width the l command wraps at unless told
+// otherwise.
+const DefaultLineLength = 70
+
+// lineLength returns the width the l command wraps at, 0 for no wrapping.
+func (opt *Options) lineLength() int {
+	switch {
+	case opt.LineLength == 0:
+		return DefaultLineLength
+	case opt.LineLength < 0:
+		return 0
+	}
+	return opt.LineLength
+}
+
+// dialect returns the dialect the regular expressions of a program are
+// written in.
+func (opt *Options) dialect() posix.Dialect {
+	if opt.ExtendRegexp {
+		return posix.ERE
+	}
+	return posix.BRE
 }
 
+// Program is a compiled sed script. A Program is never modified by running
+// it, so it is safe to use from multiple goroutines at once, with the
+// exception of FilterA and FilterStringA which share the Program's state.
 type Program struct {
 	p   *ast.Program
 	opt Options
-	s   state
+	s   ast.State
 }
 
 // MustCompile takes a sed script and compiles it into a program.
 // Panics if errors are found in script.
 func MustCompile(program string, opt Options) *Program {
 	l := lexer.New(program)
-	p := ast.New(l)
+	p := ast.New(l, opt.dialect())
 	prg := p.ParseProgram()
 	errs := p.Errors()
 	if len(errs) > 0 {
@@ -50,15 +84,109 @@ func MustCompile(program string, opt Options) *Program {
 // compilation. If unsuccessfull errors are returned.
 func Compile(program string, opt Options) (*Program, ast.ErrorList) {
 	l := lexer.New(program)
-	p := ast.New(l)
+	p := ast.New(l, opt.dialect())
 	prg := p.ParseProgram()
 	errs := p.Errors()
-	if errs != nil {
+	if len(errs) > 0 {
 		return nil, errs
 	}
 	return &Program{p: prg, opt: opt}, nil
 }
 
+// String returns the program as a script in canonical form, with one
+// command per line.
+func (p *Program) String() string {
+	return p.p.String()
+}
+
+// Statements returns a description of each statement of the program, in
+// the order they appear in the script.
+func (p *Program) Statements() []ast.StmtInfo {
+	return p.p.StmtInfos()
+}
+
+// Format returns script in canonical form, as written by Program.String,
+// with its comments kept. Compiling the result gives the same program as
+// compiling script. If script does not compile, the errors are returned.
+func Format(script string, opt Options) (string, ast.ErrorList) {
+	prg, errs := Compile(script, opt)
+	if len(errs) > 0 {
+		return "", errs
+	}
+	return prg.String(), nil
+}
+
+// Script is a named part of a sed program, such as a single -e expression
+// or the contents of a script file.
+type Script struct {
+	Name string
+	Text string
+}
+
+// CompileScripts compiles the scripts, joined by newlines, as one program.
+// Each error returned names the script it was found in, and its line and
+// offsets are relative to the start of that script.
+func CompileScripts(scripts []Script, opt Options) (*Program, ast.ErrorList) {
+	texts := make([]string, len(scripts))
+	for i, s := range scripts {
+		texts[i] = s.Text
+	}
+	prg, errs := Compile(strings.Join(texts, "\n"), opt)
+	for _, err := range errs {
+		offset, line := 0, 0
+		for _, s := range scripts {
+			next := offset + len(s.Text) + 1
+			if err.Start < next {
+				err.File = s.Name
+				break
+			}
+			offset, line = next, line+strings.Count(s.Text, "\n")+1
+		}
+		err.Line -= line
+		err.Start -= offset
+		err.End -= offset
+	}
+	return prg, errs
+}
+
+// Run runs the program over the input read from in, writing the output to
+// out as each line is processed. Unlike Filter, the input is never held in
+// memory in full, making Run suitable for large files and pipes. Run
+// returns early with the context's error if ctx is done.
+func (p *Program) Run(ctx context.Context, in io.Reader, out io.Writer) error {
+	return p.Exec(ctx, in, out).Err
+}
+
+// Exec runs the program like Run and returns the result of the run: how
+// much was read and written, the exit code given to q or Q and the first
+// I/O error encountered, if any.
+func (p *Program) Exec(ctx context.Context, in io.Reader, out io.Writer) ast.Result {
+	return p.ExecWith(ctx, in, out, RunOptions{})
+}
+
+// RunOptions are the options of a single run of a program, as opposed to
+// the Options the program is compiled with.
+type RunOptions struct {
+	InputName string     // The name of the input printed by the F command, - if empty.
+	Files     *ast.Files // If set, the files used are shared with the other runs given Files.
+}
+
+// ExecWith runs the program like Exec with the options of the run given
+// by opt.
+func (p *Program) ExecWith(ctx context.Context, in io.Reader, out io.Writer, opt RunOptions) ast.Result {
+	ro := p.opt.baseRuntimeOptions()
+	ro.InputName = opt.InputName
+	ro.Files = opt.Files
+	return p.p.Exec(ctx, in, out, ro)
+}
+
+// NewStepper returns a Stepper that runs the program over the input read
+// from in one cycle at a time.
+func (p *Program) NewStepper(in io.Reader) *ast.Stepper {
+	ro := p.opt.baseRuntimeOptions()
+	return p.p.NewStepper(in, ro)
+}
+
 func (p *Program) Filter(data []byte) []byte {
 	ro := p.opt.baseRuntimeOptions()
 	return []byte(p.p.Run(string(data), ro))
@@ -74,10 +202,8 @@ func (p *Program) FilterString(data string) string {
 // by line.
 func (p *Program) FilterA(data []byte) []byte {
 	ro := p.opt.baseRuntimeOptions()
-	ro.LineNoStart = p.s.linesRead + 1
-	res := []byte(p.p.Run(string(data), ro))
-	p.s.linesRead += countLines(string(data)) // TODO: Think of more elegant way to do this.
-	return res
+	ro.State = &p.s
+	return []byte(p.p.Run(string(data), ro))
 }
 
 // FilterStringA performs a normal filter operation but does not reset the state
@@ -85,25 +211,13 @@ func (p *Program) FilterA(data []byte) []byte {
 // You can repeatedly call FilterA to process input line by line.
 func (p *Program) FilterStringA(data string) string {
 	ro := p.opt.baseRuntimeOptions()
-	ro.LineNoStart = p.s.linesRead + 1
-	res := p.p.Run(data, ro)
-	p.s.linesRead += countLines(data) // TODO: Think of more elegant way to do this.
-	return res
-}
-
-func countLines(d string) int {
-	var ct int
-	for _, r := range d {
-		if r == '\n' {
-			ct++
-		}
-	}
-	return ct
+	ro.State = &p.s
+	return p.p.Run(data, ro)
 }
 
 func Info(program string) []token.Token {
 	l := lexer.New(program)
-	p := ast.New(l)
+	p := ast.New(l, posix.BRE)
 	prg := p.ParseProgram()
 	return prg.Tokens
 }
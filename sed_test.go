@@ -2,11 +2,20 @@ package gosed
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
-	"path"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+
+	"github.com/zkry/go-sed/ast"
+	"github.com/zkry/go-sed/backtrack"
 )
 
 // TestInfo tests to see if the ending positions returned from Info
@@ -37,70 +46,511 @@ infoTests:
 
 var update = flag.Bool("update", false, "update golden files")
 
-// The -u flag may be used to generate the golden files from the gsed command. It should
-// also be noted that the first line on the sed script determins with what options and
-// against which files the sed program should be compared. Some of the test programs are
-// genaral file editing which can work with any input while some are specially designed for
-// certain files. The first items on the comment determins whith which flags the commadn
-// should be run (beginnign with a '-' character) while the last parameter determines the
-// specific file. If no files are mentiond, it will be run against all of the test files.
-//
-// There are three directories dealing with this test case:
-//
-//   programs/
-//   inputs/
-//   expected/
+// Directories of the programs run by TestSed, their inputs and the output
+// expected of each.
+const (
+	programDir = "./testdata/programs"
+	inputDir   = "./testdata/inputs"
+	expectDir  = "./testdata/expected"
+)
+
+// goldenHeader holds the directives of the comment on the first line of a
+// test program, such as "# -n exit=5 input.txt". The options -n, -E, -r
+// and --posix are passed on to sed, exit=N is the exit code expected of
+// the program and names ending in .txt are the inputs to run it on. Any
+// other word, like the -f of a script meant to be run with sed -f, is
+// ignored.
+type goldenHeader struct {
+	opt    Options
+	args   []string // The options as arguments to sed, for -update.
+	exit   int
+	inputs []string
+}
+
+func parseGoldenHeader(prg []byte) (goldenHeader, error) {
+	var h goldenHeader
+	firstLine := string(bytes.SplitN(prg, []byte("\n"), 2)[0])
+	if !strings.HasPrefix(firstLine, "#") {
+		return h, nil
+	}
+	for _, word := range strings.Fields(strings.TrimPrefix(firstLine, "#")) {
+		switch {
+		case word == "-n":
+			h.opt.SupressOutput = true
+			h.args = append(h.args, word)
+		case word == "-E", word == "-r":
+			h.opt.ExtendRegexp = true
+			h.args = append(h.args, word)
+		case word == "--posix":
+			h.opt.Posix = true
+			h.args = append(h.args, word)
+		case strings.HasPrefix(word, "exit="):
+			code, err := strconv.Atoi(strings.TrimPrefix(word, "exit="))
+			if err != nil {
+				return h, fmt.Errorf("invalid exit code %s", word)
+			}
+			h.exit = code
+		case strings.HasSuffix(word, ".txt"):
+			h.inputs = append(h.inputs, word)
+		}
+	}
+	return h, nil
+}
+
+// TestSed runs each program in testdata/programs and compares its output
+// to the output of GNU sed kept in testdata/expected. The output of
+// program.sed run on the input input.txt is kept in program_input.txt.
+// Unless the first line of the program names the inputs it is meant for,
+// see goldenHeader, the program is run on all of the inputs.
 //
-// Program contains the test programs. Tests by default are expected to compile sucessfully
-// and any compile error will fail the test. If the programs file name contains a _fail.sed
-// then it should be expected to fail.
+// A program whose name ends in _fail.sed is expected not to compile.
 //
-// Unless otherwise stated in the programs first comment, all programs will be tested agains
-// all inputs. The expected will be generated into the expected folder with the name of the
-// file being the program name and the input name with a '_' dividor. Thus, reverse-lines.sed
-// ran with input input.txt will produce the file reverse-liens_input.txt.
+// Running the test with -update writes the expected output anew by running
+// sed, or gsed if there is one, in place of the program.
 func TestSed(t *testing.T) {
-	const programDir = "./testdata/programs"
-	const inputDir = "./testdata/inputs"
-	const expectDir = "./testdata/expected"
+	programs, err := filepath.Glob(filepath.Join(programDir, "*.sed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	allInputs := goldenInputs(t)
+
+	for _, path := range programs {
+		path := path
+		name := strings.TrimSuffix(filepath.Base(path), ".sed")
+		t.Run(name, func(t *testing.T) {
+			prgData, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := parseGoldenHeader(prgData)
+			if err != nil {
+				t.Fatalf("Program %s: %v", path, err)
+			}
 
-	prgFiles, err := ioutil.ReadDir(programDir)
+			prg, errs := Compile(string(prgData), h.opt)
+			if strings.HasSuffix(name, "_fail") {
+				if len(errs) == 0 {
+					t.Errorf("Program %s compiled, expected it to fail", path)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("Program %s did not compile.\n%v", path, errs)
+			}
+
+			inputs := h.inputs
+			if len(inputs) == 0 {
+				inputs = allInputs
+			}
+			for _, input := range inputs {
+				expectPath := filepath.Join(expectDir, name+"_"+input)
+				if *update {
+					updateGolden(t, path, h, input, expectPath)
+				}
+				runGolden(t, prg, h, input, expectPath)
+			}
+		})
+	}
+}
+
+// TestFormat checks that each test program is formatted the same when
+// formatted again, and that once formatted it still produces the expected
+// output.
+func TestFormat(t *testing.T) {
+	programs, err := filepath.Glob(filepath.Join(programDir, "*.sed"))
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
+	allInputs := goldenInputs(t)
 
-	for _, prgF := range prgFiles {
-		path := path.Join(programDir, prgF.Name())
-		prgData, err := ioutil.ReadFile(path)
-		if err != nil {
-			panic("could not open file: " + path)
+	for _, path := range programs {
+		path := path
+		name := strings.TrimSuffix(filepath.Base(path), ".sed")
+		if strings.HasSuffix(name, "_fail") {
+			continue
 		}
+		t.Run(name, func(t *testing.T) {
+			prgData, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := parseGoldenHeader(prgData)
+			if err != nil {
+				t.Fatalf("Program %s: %v", path, err)
+			}
 
-		// var inputFile string
-		opt := Options{}
+			formatted, errs := Format(string(prgData), h.opt)
+			if len(errs) != 0 {
+				t.Fatalf("Program %s did not compile.\n%v", path, errs)
+			}
+			again, errs := Format(formatted, h.opt)
+			if len(errs) != 0 {
+				t.Fatalf("Formatted program did not compile.\n%v\n%s", errs, formatted)
+			}
+			if diff := unifiedDiff("formatted", "formatted again", formatted, again); diff != "" {
+				t.Errorf("Formatting is not stable:\n%s", diff)
+			}
 
-		// Get the options from the first line.
-		firstLine := bytes.Split(prgData, []byte("\n"))[0]
-		for _, setting := range bytes.Split(firstLine, []byte(" ")) {
-			switch s := string(setting); s {
-			case "#":
-			case "-n":
-				opt.SupressOutput = true
-			default:
-				if strings.HasSuffix(s, ".txt") {
-					// inputFile = s
-				}
+			prg := MustCompile(formatted, h.opt)
+			inputs := h.inputs
+			if len(inputs) == 0 {
+				inputs = allInputs
 			}
+			for _, input := range inputs {
+				runGolden(t, prg, h, input, filepath.Join(expectDir, name+"_"+input))
+			}
+		})
+	}
+}
+
+// goldenInputs returns the names of all of the input files.
+func goldenInputs(t *testing.T) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(inputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+// runGolden runs prg on input and compares the output and the exit code
+// with those expected.
+func runGolden(t *testing.T, prg *Program, h goldenHeader, input, expectPath string) {
+	t.Helper()
+	expected, err := ioutil.ReadFile(expectPath)
+	if err != nil {
+		t.Errorf("No expected output for %s, run the test with -update: %v", input, err)
+		return
+	}
+	in, err := ioutil.ReadFile(filepath.Join(inputDir, input))
+	if err != nil {
+		t.Errorf("Could not read input %s: %v", input, err)
+		return
+	}
+	var out bytes.Buffer
+	res := prg.Exec(context.Background(), bytes.NewReader(in), &out)
+	if res.Err != nil {
+		t.Errorf("Run on %s returned error: %v", input, res.Err)
+		return
+	}
+	if res.ExitCode != h.exit {
+		t.Errorf("Run on %s exited with %d, expected %d", input, res.ExitCode, h.exit)
+	}
+	if diff := unifiedDiff(expectPath, "output", string(expected), out.String()); diff != "" {
+		t.Errorf("Run on %s produced incorrect output:\n%s", input, diff)
+	}
+}
+
+// updateGolden writes the output of sed running the program at path on
+// input to expectPath.
+func updateGolden(t *testing.T, path string, h goldenHeader, input, expectPath string) {
+	t.Helper()
+	sed, err := exec.LookPath("gsed")
+	if err != nil {
+		sed = "sed"
+	}
+	args := append(append([]string(nil), h.args...), "-f", path, filepath.Join(inputDir, input))
+	cmd := exec.Command(sed, args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	code := 0
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatalf("Could not run %s: %v", sed, err)
 		}
+		code = exitErr.ExitCode()
+	}
+	if code != h.exit {
+		t.Errorf("%s exited with %d on %s, expected %d", sed, code, input, h.exit)
+	}
+	if err := ioutil.WriteFile(expectPath, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRun checks that programs run over a stream produce the same output
+// as sed, including on the last line of input.
+func TestRun(t *testing.T) {
+	cases := []struct {
+		program string
+		input   string
+		output  string
+	}{
+		{"p", "one\ntwo\n", "one\none\ntwo\ntwo\n"},
+		{"p", "one\ntwo", "one\none\ntwo\ntwo"},
+		{"$d", "one\ntwo\nthree\n", "one\ntwo\n"},
+		{"$p", "one\ntwo\nthree\n", "one\ntwo\nthree\nthree\n"},
+		{"=", "one\ntwo\n", "1\none\n2\ntwo\n"},
+		{"n;d", "1\n2\n3\n4\n5\n", "1\n3\n5\n"},
+		{"N;s/\\n/ /", "1\n2\n3\n4\n", "1 2\n3 4\n"},
+		{"2q", "1\n2\n3\n", "1\n2\n"},
+		{"", "", ""},
+	}
+
+	for i, c := range cases {
+		prg, errs := Compile(c.program, Options{})
+		if len(errs) != 0 {
+			t.Errorf("Program [%d] %s did not compile: %v", i, c.program, errs)
+			continue
+		}
+		var out bytes.Buffer
+		if err := prg.Run(context.Background(), strings.NewReader(c.input), &out); err != nil {
+			t.Errorf("Program [%d] %s returned error: %v", i, c.program, err)
+			continue
+		}
+		if out.String() != c.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n  Expected: %q\n  Got: %q", i, c.program, c.output, out.String())
+		}
+	}
+}
+
+// TestRegexpDialect checks that patterns are read as basic regular
+// expressions unless extended ones are asked for.
+func TestRegexpDialect(t *testing.T) {
+	cases := []struct {
+		program  string
+		extended bool
+		input    string
+		output   string
+	}{
+		{"s/a\\(b*\\)c/[\\1]/", false, "xabbcx", "x[bb]x"},
+		{"s/(b+)/[&]/", false, "a(b+)c", "a[(b+)]c"},
+		{"s/[[:digit:]]\\{2\\}/N/g", false, "1 22 333", "1 N N3"},
+		{"/^[]x]/d", false, "]a\nxb\nc", "c"},
+		{"s/(b+)/[\\1]/", true, "abbc", "a[bb]c"},
+		{"/a|b/d", true, "a\nb\nc", "c"},
+		{"/a|b/d", false, "a\na|b\nc", "a\nc"},
+		{"/b\\{2\\}/s//X/", false, "abbc\nbc", "aXc\nbc"},
+		{"/b{2}/s//X/", true, "abbc\nbc", "aXc\nbc"},
+		{"s/(a|b)+/X/;//d", true, "aab\nc", "X\nc"},
+		{"s/a/A/;//d", false, "xa\naa", "xA"},
+		{"/\\(a*\\)b\\1/d", false, "aabaa\naaba\nc", "c"},
+		{"/^\\(.*\\)x\\1$/d", false, "abxab\nabxa", "abxa"},
+		{"s/\\(.\\)\\1/<\\1>/g", false, "aabccd", "<a>b<c>d"},
+		{"s/(.)\\1/<\\1>/2", true, "aabccd", "aab<c>d"},
+	}
 
-		// Attemp to compile the program, returning any errors if compilation failed.
-		_, errs := Compile(string(prgData), opt)
+	for i, c := range cases {
+		prg, errs := Compile(c.program, Options{ExtendRegexp: c.extended})
 		if len(errs) != 0 {
-			errDescBuff := bytes.Buffer{}
-			for _, errStr := range errs {
-				errDescBuff.WriteString("\n" + errStr)
+			t.Errorf("Program [%d] %s did not compile: %v", i, c.program, errs)
+			continue
+		}
+		if got := prg.FilterString(c.input); got != c.output {
+			t.Errorf("Program [%d] %s produced incorrect output.\n  Expected: %q\n  Got: %q", i, c.program, c.output, got)
+		}
+	}
+
+	if _, errs := Compile("s/a[b/c/", Options{}); len(errs) == 0 {
+		t.Errorf("Expected an invalid regexp to be reported")
+	}
+}
+
+func TestLineLength(t *testing.T) {
+	input := strings.Repeat("x", 100)
+	cases := []struct {
+		lineLength int
+		output     string
+	}{
+		{0, strings.Repeat("x", 69) + "\\\n" + strings.Repeat("x", 31) + "$"},
+		{40, strings.Repeat("x", 39) + "\\\n" + strings.Repeat("x", 39) + "\\\n" + strings.Repeat("x", 22) + "$"},
+		{-1, input + "$"},
+	}
+
+	for i, c := range cases {
+		prg := MustCompile("l", Options{SupressOutput: true, LineLength: c.lineLength})
+		if got := prg.FilterString(input); got != c.output {
+			t.Errorf("Case [%d] with line length %d produced incorrect output.\n  Expected: %q\n  Got: %q", i, c.lineLength, c.output, got)
+		}
+	}
+}
+
+// TestRunCancel checks that Run stops once its context is done.
+func TestRunCancel(t *testing.T) {
+	prg := MustCompile("p", Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var out bytes.Buffer
+	err := prg.Run(ctx, strings.NewReader("one\ntwo\n"), &out)
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected no output, got %q", out.String())
+	}
+}
+
+// TestExec checks the result of a run: what was read and written and the
+// exit code given to q or Q.
+func TestExec(t *testing.T) {
+	cases := []struct {
+		program string
+		input   string
+		result  ast.Result
+	}{
+		{"p", "one\ntwo\n", ast.Result{LinesRead: 2, LinesWritten: 4, BytesWritten: 16}},
+		{"$!d", "one\ntwo", ast.Result{LinesRead: 2, LinesWritten: 0, BytesWritten: 3}},
+		{"2q5", "1\n2\n3\n", ast.Result{LinesRead: 2, LinesWritten: 2, BytesWritten: 4, Quit: true, ExitCode: 5}},
+		{"2Q3", "1\n2\n3\n", ast.Result{LinesRead: 2, LinesWritten: 1, BytesWritten: 2, Quit: true, ExitCode: 3}},
+		{"5q5", "1\n2\n", ast.Result{LinesRead: 2, LinesWritten: 2, BytesWritten: 4}},
+	}
+
+	for i, c := range cases {
+		prg := MustCompile(c.program, Options{})
+		var out bytes.Buffer
+		res := prg.Exec(context.Background(), strings.NewReader(c.input), &out)
+		if res != c.result {
+			t.Errorf("Program [%d] %s: expected result %+v, got %+v", i, c.program, c.result, res)
+		}
+	}
+}
+
+// TestExecWriteError checks that an error writing the output ends the run
+// and is returned in the result.
+func TestExecWriteError(t *testing.T) {
+	prg := MustCompile("p", Options{})
+	res := prg.Exec(context.Background(), strings.NewReader("one\ntwo\n"), failWriter{})
+	if res.Err != errWrite {
+		t.Errorf("Expected %v, got %v", errWrite, res.Err)
+	}
+	if res.LinesRead != 1 {
+		t.Errorf("Expected the run to stop after the first line, read %d", res.LinesRead)
+	}
+}
+
+// TestExecStepLimit checks that a regexp search giving up ends the run and
+// is returned in the result, rather than taken for no match.
+func TestExecStepLimit(t *testing.T) {
+	cases := []struct {
+		program string
+		output  string
+	}{
+		{`/\(a*\)*\1b/d`, ""},
+		{`s/\(a*\)*\1b/x/`, "ax\n"},
+	}
+	for _, c := range cases {
+		prg := MustCompile(c.program, Options{})
+		input := "ab\n" + strings.Repeat("a", 40) + "\nab\n"
+		var out bytes.Buffer
+		res := prg.Exec(context.Background(), strings.NewReader(input), &out)
+		if res.Err == nil || !strings.Contains(res.Err.Error(), backtrack.ErrStepLimit.Error()) {
+			t.Errorf("Program %s: expected %v, got %v", c.program, backtrack.ErrStepLimit, res.Err)
+		}
+		if res.LinesRead != 2 {
+			t.Errorf("Program %s: expected the run to stop after the second line, read %d", c.program, res.LinesRead)
+		}
+		// Nothing is output for the line the search gave up on.
+		if out.String() != c.output {
+			t.Errorf("Program %s: expected output %q, got %q", c.program, c.output, out.String())
+		}
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+// TestFilterState checks that Filter starts every call afresh while FilterA
+// carries the line number, hold space and ranges over to the next call.
+func TestFilterState(t *testing.T) {
+	prg := MustCompile("/start/,/end/d", Options{})
+	for i := 0; i < 2; i++ {
+		if got := prg.FilterString("a\nstart\nb"); got != "a" {
+			t.Errorf("Filter [%d]: expected %q, got %q", i, "a", got)
+		}
+	}
+	if got := prg.FilterString("c\nend\nd"); got != "c\nend\nd" {
+		t.Errorf("Filter: expected %q, got %q", "c\nend\nd", got)
+	}
+
+	prg = MustCompile("/start/,/end/d;=", Options{SupressOutput: true})
+	want := []string{"1", "", "5"}
+	for i, in := range []string{"a\nstart", "b\nend", "c"} {
+		if got := prg.FilterStringA(in); got != want[i] {
+			t.Errorf("FilterA [%d]: expected %q, got %q", i, want[i], got)
+		}
+	}
+
+	prg = MustCompile("x", Options{})
+	want = []string{"", "a", "b"}
+	for i, in := range []string{"a", "b", "c"} {
+		if got := prg.FilterStringA(in); got != want[i] {
+			t.Errorf("FilterA [%d]: expected %q, got %q", i, want[i], got)
+		}
+	}
+}
+
+// TestConcurrentRun checks that a single Program can be run from many
+// goroutines at once without the runs affecting each other.
+func TestConcurrentRun(t *testing.T) {
+	prg := MustCompile("/start/,/end/c\\\nchanged", Options{})
+	const input = "a\nstart\nb\nend\nc\n"
+	const output = "a\nchanged\nc\n"
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				var out bytes.Buffer
+				if err := prg.Run(context.Background(), strings.NewReader(input), &out); err != nil {
+					errs <- err.Error()
+					return
+				}
+				if out.String() != output {
+					errs <- out.String()
+					return
+				}
 			}
-			t.Errorf("Program %s did not compile. %s", path, errDescBuff.String())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for got := range errs {
+		t.Errorf("Expected %q, got %q", output, got)
+	}
+}
+
+// TestCompileScripts checks that errors are reported relative to the
+// script they were found in.
+func TestCompileScripts(t *testing.T) {
+	scripts := []Script{
+		{Name: "-e #1", Text: "p"},
+		{Name: "prog.sed", Text: "1d\n\n1,x p"},
+		{Name: "-e #2", Text: "s/a/b/;:"},
+	}
+	_, errs := CompileScripts(scripts, Options{})
+	expected := []struct {
+		file         string
+		line, column int
+		start        int
+	}{
+		{"prog.sed", 3, 3, 6},
+		{"-e #2", 1, 9, 8},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, exp := range expected {
+		err := errs[i]
+		if err.File != exp.file || err.Line != exp.line || err.Column != exp.column || err.Start != exp.start {
+			t.Errorf("Error [%d]: expected %s:%d:%d at %d, got %s:%d:%d at %d", i,
+				exp.file, exp.line, exp.column, exp.start, err.File, err.Line, err.Column, err.Start)
 		}
 	}
+
+	if _, errs := CompileScripts(scripts[:1], Options{}); len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
 }
@@ -24,6 +24,8 @@ const (
 	LBRACE    = "{"
 	RBRACE    = "}"
 	EXPLMARK  = "!"
+	TILDE     = "~"
+	PLUS      = "+"
 
 	SEMICOLON = ";"
 	NEWLINE   = "\\n"